@@ -0,0 +1,172 @@
+package accesspolicy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Rule allows methods on the Tower paths matching one of its patterns. In a pattern * matches
+// a single path segment e.g. /api/v2/job_templates/*/launch/. Labels and organizations only
+// restrict launches and posts to launch paths, the launched template needs one of the labels and must belong to one
+// of the organizations, given by name or id.
+type Rule struct {
+	Methods       []string `json:"methods"` // get, post, launch or monitor
+	Paths         []string `json:"paths"`
+	Labels        []string `json:"labels,omitempty"`
+	Organizations []string `json:"organizations,omitempty"`
+}
+
+// Policy lists the rules for the jobs a task may run, a job that matches no rule is rejected
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Template describes the job template or workflow job template of a launch
+type Template struct {
+	Labels         []string
+	Organization   string
+	OrganizationID string
+}
+
+// RejectedError is returned for a job the policy does not allow
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "Rejected by the access policy, " + e.Reason
+}
+
+// Configured loads the policy file named by worker.access_policy_file, nil if none is configured
+func Configured() (*Policy, error) {
+	file := viper.GetString("worker.access_policy_file")
+	if file == "" {
+		return nil, nil
+	}
+	return Load(file)
+}
+
+// Load reads a policy file
+func Load(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the access policy %s %v", file, err)
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("Error parsing the access policy %s %v", file, err)
+	}
+	for i, r := range p.Rules {
+		for _, pattern := range r.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid path pattern %q in rule %d of the access policy %s", pattern, i, file)
+			}
+		}
+	}
+	return p, nil
+}
+
+type policyKey struct{}
+
+// WithPolicy returns a ctx for the workers of a task that carries the policy
+func WithPolicy(ctx context.Context, p *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// FromContext returns the policy of the task, nil if no policy is configured
+func FromContext(ctx context.Context) *Policy {
+	p, _ := ctx.Value(policyKey{}).(*Policy)
+	return p
+}
+
+// Check returns a RejectedError unless a rule allows the method on the path. The template is
+// only looked up for the rules that restrict launches. A post to a launch path launches the
+// template like a launch does, so the restrictions apply to it too. A nil policy allows everything.
+func (p *Policy) Check(method string, urlPath string, template func() (Template, error)) error {
+	if p == nil {
+		return nil
+	}
+	method = strings.ToLower(method)
+	for _, segment := range strings.Split(urlPath, "/") {
+		if segment == "." || segment == ".." {
+			return &RejectedError{Reason: fmt.Sprintf("the path %s has dot segments", urlPath)}
+		}
+	}
+	normalized := urlPath
+	if !strings.HasSuffix(normalized, "/") {
+		normalized += "/"
+	}
+
+	launches := method == "launch" || (method == "post" && strings.HasSuffix(normalized, "/launch/"))
+	var t *Template
+	restricted := false
+	for _, r := range p.Rules {
+		if !r.matches(method, normalized) {
+			continue
+		}
+		if !launches || (len(r.Labels) == 0 && len(r.Organizations) == 0) {
+			return nil
+		}
+		restricted = true
+		if t == nil {
+			found, err := template()
+			if err != nil {
+				return &RejectedError{Reason: fmt.Sprintf("the template of %s could not be checked %v", urlPath, err)}
+			}
+			t = &found
+		}
+		if r.allows(*t) {
+			return nil
+		}
+	}
+	if restricted {
+		return &RejectedError{Reason: fmt.Sprintf("the template of %s has no allowed label or organization", urlPath)}
+	}
+	return &RejectedError{Reason: fmt.Sprintf("%s of %s is not allowed", method, urlPath)}
+}
+
+func (r Rule) matches(method string, urlPath string) bool {
+	if !includes(method, r.Methods) {
+		return false
+	}
+	for _, pattern := range r.Paths {
+		if !strings.HasSuffix(pattern, "/") {
+			pattern += "/"
+		}
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allows checks the launch restrictions of the rule, every restriction that is set must be met
+func (r Rule) allows(t Template) bool {
+	if len(r.Organizations) > 0 && !includes(t.Organization, r.Organizations) && !includes(t.OrganizationID, r.Organizations) {
+		return false
+	}
+	if len(r.Labels) > 0 {
+		for _, label := range t.Labels {
+			if includes(label, r.Labels) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func includes(s string, values []string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
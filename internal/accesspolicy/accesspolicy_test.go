@@ -0,0 +1,104 @@
+package accesspolicy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPolicy() *Policy {
+	return &Policy{Rules: []Rule{
+		{Methods: []string{"get"}, Paths: []string{"/api/v2/job_templates/", "/api/v2/job_templates/*/survey_spec"}},
+		{Methods: []string{"launch"}, Paths: []string{"/api/v2/job_templates/*/launch/"}, Labels: []string{"cloud"}},
+		{Methods: []string{"launch"}, Paths: []string{"/api/v2/workflow_job_templates/*/launch/"}, Organizations: []string{"Default", "7"}},
+	}}
+}
+
+func noTemplate() (Template, error) {
+	return Template{}, errors.New("No template lookup expected")
+}
+
+func template(t Template) func() (Template, error) {
+	return func() (Template, error) { return t, nil }
+}
+
+func TestCheckPaths(t *testing.T) {
+	p := testPolicy()
+	assert.NoError(t, p.Check("GET", "/api/v2/job_templates/", noTemplate))
+	assert.NoError(t, p.Check("get", "/api/v2/job_templates", noTemplate), "The trailing slash is optional")
+	assert.NoError(t, p.Check("get", "/api/v2/job_templates/12/survey_spec/", noTemplate))
+
+	err := p.Check("get", "/api/v2/users/", noTemplate)
+	assert.Equal(t, &RejectedError{Reason: "get of /api/v2/users/ is not allowed"}, err)
+	assert.Error(t, p.Check("post", "/api/v2/job_templates/", noTemplate), "Only the listed methods are allowed")
+	assert.Error(t, p.Check("get", "/api/v2/job_templates/12/", noTemplate), "* does not match the end of the path")
+	assert.Error(t, p.Check("get", "/api/v2/job_templates/12/survey_spec/../../../users/", noTemplate))
+}
+
+func TestCheckLaunch(t *testing.T) {
+	p := testPolicy()
+	assert.NoError(t, p.Check("launch", "/api/v2/job_templates/12/launch/", template(Template{Labels: []string{"inventory", "Cloud"}})))
+	err := p.Check("launch", "/api/v2/job_templates/12/launch/", template(Template{Labels: []string{"inventory"}}))
+	assert.Equal(t, &RejectedError{Reason: "the template of /api/v2/job_templates/12/launch/ has no allowed label or organization"}, err)
+
+	assert.NoError(t, p.Check("launch", "/api/v2/workflow_job_templates/3/launch/", template(Template{Organization: "Default"})))
+	assert.NoError(t, p.Check("launch", "/api/v2/workflow_job_templates/3/launch/", template(Template{Organization: "Other", OrganizationID: "7"})))
+	assert.Error(t, p.Check("launch", "/api/v2/workflow_job_templates/3/launch/", template(Template{Organization: "Other", OrganizationID: "8"})))
+
+	err = p.Check("launch", "/api/v2/job_templates/12/launch/", noTemplate)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Rejected by the access policy, the template of /api/v2/job_templates/12/launch/ could not be checked")
+	}
+}
+
+func TestCheckPostLaunch(t *testing.T) {
+	p := &Policy{Rules: []Rule{
+		{Methods: []string{"post"}, Paths: []string{"/api/v2/job_templates/*/launch/"}, Labels: []string{"cloud"}},
+		{Methods: []string{"post"}, Paths: []string{"/api/v2/inventories/"}, Labels: []string{"cloud"}},
+	}}
+	assert.NoError(t, p.Check("post", "/api/v2/job_templates/12/launch/", template(Template{Labels: []string{"cloud"}})))
+	err := p.Check("post", "/api/v2/job_templates/12/launch", template(Template{Labels: []string{"inventory"}}))
+	assert.Equal(t, &RejectedError{Reason: "the template of /api/v2/job_templates/12/launch has no allowed label or organization"}, err)
+	assert.Error(t, p.Check("post", "/api/v2/job_templates/12/launch/", noTemplate))
+
+	assert.NoError(t, p.Check("post", "/api/v2/inventories/", noTemplate), "Labels only restrict launches")
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	assert.NoError(t, p.Check("post", "/api/v2/users/", noTemplate))
+	assert.Nil(t, FromContext(context.Background()))
+	assert.Equal(t, testPolicy(), FromContext(WithPolicy(context.Background(), testPolicy())))
+}
+
+func TestConfigured(t *testing.T) {
+	p, err := Configured()
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	dir, err := ioutil.TempDir("", "accesspolicy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.json")
+	viper.Set("worker.access_policy_file", file)
+	defer viper.Set("worker.access_policy_file", nil)
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"rules": [{"methods": ["get"], "paths": ["/api/v2/[/"]}]}`), 0600))
+	_, err = Configured()
+	assert.Error(t, err, "Invalid pattern")
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"rules": [{"methods": ["launch"], "paths": ["/api/v2/job_templates/*/launch/"], "labels": ["cloud"]}]}`), 0600))
+	p, err = Configured()
+	assert.NoError(t, err)
+	assert.Equal(t, &Policy{Rules: []Rule{{Methods: []string{"launch"}, Paths: []string{"/api/v2/job_templates/*/launch/"}, Labels: []string{"cloud"}}}}, p)
+
+	p, err = Load("../../testdata/access_policy_sample.json")
+	assert.NoError(t, err, "The sample is valid")
+	assert.NoError(t, p.Check("monitor", "/api/v2/jobs/12/", noTemplate))
+}
@@ -0,0 +1,47 @@
+package canonical
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Marshal serializes a decoded JSON value so that equal data always produces equal bytes.
+// Object keys are sorted and json.Number values, which keep the formatting used by
+// the sender, are rewritten in their shortest form e.g. 1.50 and 15e-1 both become 1.5
+func Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(normalize(v))
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			m[key] = normalize(element)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, element := range v {
+			a[i] = normalize(element)
+		}
+		return a
+	case json.Number:
+		return normalizeNumber(v)
+	}
+	return v
+}
+
+func normalizeNumber(n json.Number) interface{} {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return json.Number(strconv.FormatInt(i, 10))
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return n
+	}
+	if f == float64(int64(f)) && f >= -(1<<53) && f <= 1<<53 {
+		return json.Number(strconv.FormatInt(int64(f), 10))
+	}
+	return f
+}
@@ -0,0 +1,35 @@
+package canonical
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.UseNumber()
+	assert.NoError(t, decoder.Decode(&v))
+	return v
+}
+
+func TestMarshal(t *testing.T) {
+	a := decode(t, `{"name": "jt1", "id": 1, "nested": {"z": 1.50, "a": [3.0, 1e2, -0.25]}, "big": 9007199254740993}`)
+	b := decode(t, `{"big": 9007199254740993, "nested": {"a": [3, 100, -25e-2], "z": 15e-1}, "id": 1.0, "name": "jt1"}`)
+
+	ba, err := Marshal(a)
+	assert.NoError(t, err)
+	bb, err := Marshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"big":9007199254740993,"id":1,"name":"jt1","nested":{"a":[3,100,-0.25],"z":1.5}}`, string(ba))
+	assert.Equal(t, ba, bb)
+}
+
+func TestMarshalPlainValues(t *testing.T) {
+	b, err := Marshal(map[string]interface{}{"b": float64(2), "a": nil, "c": true})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":null,"b":2,"c":true}`, string(b))
+}
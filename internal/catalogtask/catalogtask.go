@@ -5,11 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
 )
 
 // CatalogTask is an interface that gets or updates a catalog task
@@ -19,20 +23,25 @@ type CatalogTask interface {
 }
 
 type defaultCatalogTask struct {
-	url  string
-	ctx  context.Context
-	glog logger.Logger
+	url    string
+	ctx    context.Context
+	glog   logger.Logger
+	policy retry.Policy
 }
 
-// MakeCatalogTask returns a struct that implements interface CatalogTask
+// MakeCatalogTask returns a struct that implements interface CatalogTask.
+// Calls to the task API are retried with the policy of the worker.task_retry config section.
 func MakeCatalogTask(ctx context.Context, url string) CatalogTask {
 	glog := logger.GetLogger(ctx)
+	policy := retry.MakePolicy("worker.task_retry")
+	// An update sets the state of the task, sending it again has the same effect
+	policy.RetryNonIdempotent = true
 
-	return &defaultCatalogTask{ctx: ctx, url: url, glog: glog}
+	return &defaultCatalogTask{ctx: ctx, url: url, glog: glog, policy: policy}
 }
 
 func (ct *defaultCatalogTask) Get() (*common.CatalogInventoryTask, error) {
-	body, err := getWorkPayload(ct.glog, ct.url)
+	body, err := ct.send(http.MethodGet, nil)
 	if err != nil {
 		ct.glog.Errorf("Error reading payload in %s %v", ct.url, err)
 		return nil, err
@@ -52,77 +61,77 @@ func (ct *defaultCatalogTask) Update(data map[string]interface{}) error {
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPatch, ct.url, bytes.NewBuffer(payload))
-	req.Header.Set("Content-Type", "application/json")
+	body, err := ct.send(http.MethodPatch, payload)
 	if err != nil {
-		ct.glog.Errorf("Error creating a new request %v", err)
 		return err
 	}
+	ct.glog.Infof("Response from Patch %s", string(body))
+	return nil
+}
 
-	client, err := common.MakeHTTPClient(req)
-	if err != nil {
-		ct.glog.Errorf("Error creating a http client %v", err)
-		return err
+// send calls the task API and retries network errors and transient HTTP statuses.
+// Any 2xx status is a success.
+func (ct *defaultCatalogTask) send(method string, payload []byte) ([]byte, error) {
+	attempts := ct.policy.Attempts(method)
+	for attempt := 1; ; attempt++ {
+		body, resp, err := ct.doRequest(method, payload)
+		if err == nil && successCode(resp.StatusCode) {
+			ct.glog.Infof("Task %s Status Code %d", method, resp.StatusCode)
+			return body, nil
+		}
+		retryable := true
+		var header http.Header
+		if err == nil {
+			err = fmt.Errorf("Invalid HTTP Status code from %s %s, status: %d", strings.ToLower(method), ct.url, resp.StatusCode)
+			retryable = retry.RetryableStatus(resp.StatusCode)
+			header = resp.Header
+		}
+		ct.glog.Errorf("Attempt %d of %d failed %v", attempt, attempts, err)
+		if !retryable || attempt >= attempts {
+			return nil, err
+		}
+		select {
+		case <-time.After(ct.policy.Backoff(attempt, header)):
+		case <-ct.ctx.Done():
+			return nil, ct.ctx.Err()
+		}
 	}
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		ct.glog.Errorf("Error processing request %v", err)
-		return err
+func (ct *defaultCatalogTask) doRequest(method string, payload []byte) ([]byte, *http.Response, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewBuffer(payload)
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
+	req, err := http.NewRequestWithContext(ct.ctx, method, ct.url, reqBody)
 	if err != nil {
-		ct.glog.Errorf("Error reading body %v", err)
-		return err
+		ct.glog.Errorf("Error creating request %s %v", ct.url, err)
+		return nil, nil, err
 	}
-	if resp.StatusCode != http.StatusNoContent {
-		err = fmt.Errorf("Invalid HTTP Status code from patch %d", resp.StatusCode)
-		ct.glog.Errorf("Error %v", err)
-		return err
-	}
-	ct.glog.Infof("Task Update Status Code %d", resp.StatusCode)
-	ct.glog.Infof("Response from Patch %s", string(body))
-	return nil
-}
-
-func getWorkPayload(glog logger.Logger, url string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		glog.Errorf("Error creating request %s %v", url, err)
-		return nil, err
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
 	client, err := common.MakeHTTPClient(req)
 	if err != nil {
-		glog.Errorf("Error creating http client %v", err)
-		return nil, err
+		ct.glog.Errorf("Error creating http client %v", err)
+		return nil, nil, err
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		glog.Errorf("Error fetching request %s %v", url, err)
-		return nil, err
-	}
-	if !successGetCode(resp.StatusCode) {
-		err = fmt.Errorf("Invalid HTTP Status code from get %s, status: %d", url, resp.StatusCode)
-		glog.Errorf("Error %v", err)
-		return nil, err
+		return nil, nil, err
 	}
-
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp, nil
 }
 
-func successGetCode(code int) bool {
-	var validCodes = [...]int{200, 201, 202}
-	for _, v := range validCodes {
-		if v == code {
-			return true
-		}
-	}
-	return false
+func successCode(code int) bool {
+	return code >= 200 && code < 300
 }
 
 // Parse the request into CatalogInventoryTask
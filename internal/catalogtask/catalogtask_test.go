@@ -5,9 +5,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
@@ -56,6 +58,7 @@ func TestGetBad(t *testing.T) {
 }
 
 func TestUpdate(t *testing.T) {
+	fastRetry(t)
 	data := map[string]interface{}{"state": "completed", "status": "ok"}
 	retCode := http.StatusNoContent
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -72,3 +75,64 @@ func TestUpdate(t *testing.T) {
 		assert.True(t, strings.Contains(err.Error(), "Invalid HTTP Status code"))
 	}
 }
+
+func fastRetry(t *testing.T) {
+	viper.Set("worker.task_retry.base_backoff_ms", 1)
+	t.Cleanup(func() { viper.Set("worker.task_retry.base_backoff_ms", nil) })
+}
+
+func TestUpdateRetry(t *testing.T) {
+	fastRetry(t)
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	task := MakeCatalogTask(logger.CtxWithLoggerID(context.Background(), "123"), ts.URL)
+	assert.NoError(t, task.Update(map[string]interface{}{"state": "completed"}), "Any 2xx is a success")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestUpdateNotRetried(t *testing.T) {
+	fastRetry(t)
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	task := MakeCatalogTask(logger.CtxWithLoggerID(context.Background(), "123"), ts.URL)
+	assert.Error(t, task.Update(map[string]interface{}{"state": "completed"}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "Client errors are not retried")
+}
+
+func TestGetRetryNetworkError(t *testing.T) {
+	fastRetry(t)
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// drop the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			assert.NoError(t, err)
+			conn.Close()
+			return
+		}
+		_, err := w.Write([]byte(`{"id":"12345","state":"pending"}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	task := MakeCatalogTask(logger.CtxWithLoggerID(context.Background(), "123"), ts.URL)
+	reqMessage, err := task.Get()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "12345", reqMessage.ID)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
@@ -1,16 +1,23 @@
 package common
 
-import "time"
+import (
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/ratelimit"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
+)
 
 // CatalogConfig stores the config parameters for the
 // Catalog Worker
 type CatalogConfig struct {
-	Level                 string // The Log Level
-	URL                   string // The URL to your Ansible Tower
-	Token                 string // The Token used to authenticate with Ansible Tower
-	SkipVerifyCertificate bool   // Skip Certifcate Validation
-	MQTTURL               string // The URL for MQTT Server
-	GUID                  string // The Client GUID
+	Level                 string             // The Log Level
+	URL                   string             // The URL to your Ansible Tower
+	Token                 string             // The Token used to authenticate with Ansible Tower
+	SkipVerifyCertificate bool               // Skip Certifcate Validation
+	MQTTURL               string             // The URL for MQTT Server
+	GUID                  string             // The Client GUID
+	Retry                 retry.Policy       // The retry policy for Ansible Tower API calls
+	RateLimiter           *ratelimit.Limiter // Limits the rate of all Ansible Tower API calls, shared by all tasks
 }
 
 // JobParam stores the single parameter set for a job
@@ -23,15 +30,17 @@ type JobParam struct {
 	RefreshIntervalSeconds int64                  `json:"refresh_interval_seconds"`
 	FetchRelated           []interface{}          `json:"fetch_related"`
 	PagePrefix             string                 `json:"page_prefix"`
+	ContinueOnError        bool                   `json:"continue_on_error"` // A failure of this job or its related jobs does not fail the task
 }
 
 // RequestInput describes the struct of input attribute in RequestMessage
 type RequestInput struct {
-	ResponseFormat string     `json:"response_format"`
-	UploadURL      string     `json:"upload_url"`
-	Jobs           []JobParam `json:"jobs"`
-	PreviousSHA    string     `json:"previous_sha"`
-	PreviousSize   int64      `json:"previous_size"`
+	ResponseFormat     string     `json:"response_format"`
+	UploadURL          string     `json:"upload_url"`
+	Jobs               []JobParam `json:"jobs"`
+	PreviousSHA        string     `json:"previous_sha"`
+	PreviousSize       int64      `json:"previous_size"`
+	PreviousContentSHA string     `json:"previous_content_sha"`
 }
 
 // CatalogInventoryTask stores all attributes of a task retrived from catalog-inventory API
@@ -47,7 +56,8 @@ type CatalogInventoryTask struct {
 // MQTTMessage stores all attributes of the MQTTMessage sent by catalog-inventory API
 // TODO: remove when mqtt client is no longer needed
 type MQTTMessage struct {
-	URL string `json:"url"`
+	URL    string `json:"url"`
+	Cancel bool   `json:"cancel"` // Cancels the running task of the URL instead of starting it
 }
 
 // Page stores data in a page with a name
@@ -60,5 +70,12 @@ type Page struct {
 type PageWriter interface {
 	Write(name string, b []byte) error
 	Flush() error
-	FlushErrors(msg []string) error
+	FlushErrors(errors []JobError) error
+	FlushPartial(errors []JobError) error
+	Abort(status string, message string, errors []JobError) error
+}
+
+// PhaseObserver is implemented by the page writers that report the phase of a flush
+type PhaseObserver interface {
+	ObservePhase(func(phase string))
 }
@@ -0,0 +1,24 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+// JobError describes why a job failed, it is sent to the cloud as part of the task output
+type JobError struct {
+	Href       string    `json:"href"`
+	Method     string    `json:"method"`
+	HTTPStatus int       `json:"http_status"`
+	Message    string    `json:"message"`
+	Detail     string    `json:"detail,omitempty"`  // Error detail parsed from the Ansible Tower response
+	Retryable  bool      `json:"retryable"`         // The job might succeed when the task is run again
+	Attempt    int       `json:"attempt,omitempty"` // The call reported by this record, a failed call is reported once per attempt
+	Attempts   int       `json:"attempts"`          // Number of Ansible Tower calls made, 0 if the job failed without a call
+	Timestamp  time.Time `json:"timestamp"`         // When the job or the reported attempt failed
+}
+
+// Error formats the job error for the logs
+func (e JobError) Error() string {
+	return fmt.Sprintf("URL: %s Status: %d Message: %s", e.Href, e.HTTPStatus, e.Message)
+}
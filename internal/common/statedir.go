@@ -0,0 +1,13 @@
+package common
+
+import "github.com/spf13/viper"
+
+const defaultStateDir = "/var/lib/rhc-catalog-worker"
+
+// StateDir returns the directory where the worker keeps its state across restarts
+func StateDir() string {
+	if dir := viper.GetString("worker.state_dir"); dir != "" {
+		return dir
+	}
+	return defaultStateDir
+}
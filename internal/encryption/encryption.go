@@ -0,0 +1,211 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// Scheme names the format of an encrypted archive: a random AES-256 key, wrapped with
+	// RSA-OAEP SHA-256 for every recipient, encrypts the archive in AES-GCM chunks.
+	Scheme = "rsa-oaep-sha256+aes-256-gcm-stream"
+	// ChunkSize is the plaintext size of every chunk but the last one
+	ChunkSize = 64 * 1024
+	keySize   = 32
+)
+
+// Recipient is a public key the archives are encrypted to
+type Recipient struct {
+	KeyID string // Hex sha256 of the DER encoded public key
+	Key   *rsa.PublicKey
+}
+
+// WrappedKey is the archive key encrypted to a recipient
+type WrappedKey struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey string `json:"wrapped_key"` // Standard base64
+}
+
+// Envelope describes an encrypted archive, it is everything a recipient needs besides its private key
+type Envelope struct {
+	Scheme     string       `json:"scheme"`
+	ChunkSize  int          `json:"chunk_size"`
+	Recipients []WrappedKey `json:"recipients"`
+	SHA256     string       `json:"sha256"` // The sha256 of the encrypted archive
+	Size       int64        `json:"size"`   // The size of the encrypted archive
+}
+
+// Configured returns the recipients listed in worker.encryption.recipients,
+// none if encryption is disabled
+func Configured() ([]Recipient, error) {
+	if !viper.GetBool("worker.encryption.enabled") {
+		return nil, nil
+	}
+	files := viper.GetStringSlice("worker.encryption.recipients")
+	if len(files) == 0 {
+		return nil, errors.New("Encryption is enabled without recipients")
+	}
+	return LoadRecipients(files)
+}
+
+// LoadRecipients reads RSA public keys from PEM files holding a certificate or a public key
+func LoadRecipients(files []string) ([]Recipient, error) {
+	var recipients []Recipient
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading recipient %s %v", file, err)
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("Recipient %s is not PEM encoded", file)
+		}
+		var pub interface{}
+		switch block.Type {
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				pub = cert.PublicKey
+			}
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		default:
+			err = fmt.Errorf("unexpected PEM block %s", block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing recipient %s %v", file, err)
+		}
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Recipient %s is not an RSA key", file)
+		}
+		recipient, err := MakeRecipient(key)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// MakeRecipient creates a recipient for an RSA public key
+func MakeRecipient(key *rsa.PublicKey) (Recipient, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return Recipient{}, err
+	}
+	sum := sha256.Sum256(der)
+	return Recipient{KeyID: hex.EncodeToString(sum[:]), Key: key}, nil
+}
+
+// Writer encrypts everything written to it. The data is sealed in chunks of ChunkSize, the
+// nonce of a chunk is its counter and a flag marking the last chunk, so chunks can't be
+// reordered, dropped or truncated unnoticed. Close must be called to seal the last chunk.
+type Writer struct {
+	out      io.Writer
+	aead     cipher.AEAD
+	buf      []byte
+	counter  uint64
+	digest   hash.Hash
+	size     int64
+	envelope Envelope
+}
+
+// NewWriter encrypts to out with a new key wrapped for every recipient
+func NewWriter(out io.Writer, recipients []Recipient) (*Writer, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("No recipients to encrypt to")
+	}
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		out:      out,
+		aead:     aead,
+		digest:   sha256.New(),
+		envelope: Envelope{Scheme: Scheme, ChunkSize: ChunkSize},
+	}
+	for _, r := range recipients {
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, r.Key, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error wrapping the key for recipient %s %v", r.KeyID, err)
+		}
+		w.envelope.Recipients = append(w.envelope.Recipients, WrappedKey{KeyID: r.KeyID, WrappedKey: base64.StdEncoding.EncodeToString(wrapped)})
+	}
+	return w, nil
+}
+
+// Write encrypts p, a chunk is only sealed once it is known not to be the last one
+func (w *Writer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > ChunkSize {
+		if err := w.seal(w.buf[:ChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[ChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close seals the last chunk, it does not close the underlying writer
+func (w *Writer) Close() error {
+	err := w.seal(w.buf, true)
+	w.buf = nil
+	return err
+}
+
+// Envelope describes the encrypted archive, complete after Close
+func (w *Writer) Envelope() Envelope {
+	env := w.envelope
+	env.SHA256 = hex.EncodeToString(w.digest.Sum(nil))
+	env.Size = w.size
+	return env
+}
+
+func (w *Writer) seal(chunk []byte, last bool) error {
+	sealed := w.aead.Seal(nil, nonce(w.counter, last), chunk, nil)
+	w.counter++
+	n, err := w.out.Write(sealed)
+	w.digest.Write(sealed[:n])
+	w.size += int64(n)
+	return err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce is the big endian chunk counter followed by a byte marking the last chunk
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
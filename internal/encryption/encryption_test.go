@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return key
+}
+
+func encrypt(t *testing.T, data []byte, keys ...*rsa.PrivateKey) ([]byte, Envelope) {
+	var recipients []Recipient
+	for _, key := range keys {
+		r, err := MakeRecipient(&key.PublicKey)
+		assert.NoError(t, err)
+		recipients = append(recipients, r)
+	}
+	var out bytes.Buffer
+	w, err := NewWriter(&out, recipients)
+	if !assert.NoError(t, err) {
+		return nil, Envelope{}
+	}
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return out.Bytes(), w.Envelope()
+}
+
+// newReader decrypts an archive described by env with the private key of one of its recipients
+func newReader(in io.Reader, env Envelope, key *rsa.PrivateKey) (io.Reader, error) {
+	if env.Scheme != Scheme {
+		return nil, fmt.Errorf("Unsupported encryption scheme %s", env.Scheme)
+	}
+	recipient, err := MakeRecipient(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, wk := range env.Recipients {
+		if wk.KeyID != recipient.KeyID {
+			continue
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(wk.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		archiveKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, wrapped, nil)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(archiveKey)
+		if err != nil {
+			return nil, err
+		}
+		return &reader{in: bufio.NewReader(in), aead: aead, chunkSize: env.ChunkSize}, nil
+	}
+	return nil, errors.New("The archive is not encrypted to this key")
+}
+
+type reader struct {
+	in        *bufio.Reader
+	aead      cipher.AEAD
+	chunkSize int
+	counter   uint64
+	plain     []byte
+	done      bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk, it is the last one if nothing follows it
+func (r *reader) open() error {
+	sealed := make([]byte, r.chunkSize+r.aead.Overhead())
+	n, err := io.ReadFull(r.in, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("Encrypted archive is truncated")
+		}
+		return err
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := r.in.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	plain, err := r.aead.Open(nil, nonce(r.counter, last), sealed[:n], nil)
+	if err != nil {
+		return errors.New("Encrypted archive is corrupted or truncated")
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	first, second := testKey(t), testKey(t)
+	for _, size := range []int{0, 10, ChunkSize, 3*ChunkSize + 7} {
+		data := []byte(strings.Repeat("x", size))
+		sealed, env := encrypt(t, data, first, second)
+
+		assert.Equal(t, Scheme, env.Scheme)
+		assert.Equal(t, 2, len(env.Recipients))
+		assert.Equal(t, int64(len(sealed)), env.Size)
+		sum := sha256.Sum256(sealed)
+		assert.Equal(t, hex.EncodeToString(sum[:]), env.SHA256)
+
+		for _, key := range []*rsa.PrivateKey{first, second} {
+			r, err := newReader(bytes.NewReader(sealed), env, key)
+			if assert.NoError(t, err) {
+				plain, err := ioutil.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, data, plain, "size %d", size)
+			}
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := testKey(t)
+	sealed, env := encrypt(t, []byte(strings.Repeat("x", 2*ChunkSize+1)), key)
+
+	truncated := sealed[:ChunkSize+16]
+	r, err := newReader(bytes.NewReader(truncated), env, key)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err, "A dropped last chunk is detected")
+
+	corrupted := append([]byte(nil), sealed...)
+	corrupted[10]++
+	r, err = newReader(bytes.NewReader(corrupted), env, key)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+
+	_, err = newReader(bytes.NewReader(sealed), env, testKey(t))
+	assert.Error(t, err, "Not a recipient")
+}
+
+func TestConfigured(t *testing.T) {
+	recipients, err := Configured()
+	assert.NoError(t, err)
+	assert.Empty(t, recipients, "Disabled by default")
+
+	key := testKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "encryption")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "recipient.pem")
+	assert.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	viper.Set("worker.encryption.enabled", true)
+	defer viper.Set("worker.encryption.enabled", nil)
+	_, err = Configured()
+	assert.Error(t, err, "Enabled without recipients")
+
+	viper.Set("worker.encryption.recipients", []string{file})
+	defer viper.Set("worker.encryption.recipients", nil)
+	recipients, err = Configured()
+	assert.NoError(t, err)
+	expected, _ := MakeRecipient(&key.PublicKey)
+	assert.Equal(t, []Recipient{expected}, recipients)
+}
@@ -1,6 +1,7 @@
 package filters
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/jmespath/go-jmespath"
@@ -29,7 +30,13 @@ func (f *Value) Apply(jsonBody map[string]interface{}) (map[string]interface{},
 	if f.ReplaceResults {
 		jsonBody["results"] = result
 	} else {
-		jsonBody = result.(map[string]interface{})
+		obj, ok := result.(map[string]interface{})
+		if !ok {
+			err = fmt.Errorf("Filter %s returned %T instead of an object", f.Data, result)
+			log.Error(err)
+			return nil, err
+		}
+		jsonBody = obj
 	}
 	return jsonBody, nil
 }
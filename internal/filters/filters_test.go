@@ -25,6 +25,13 @@ func TestMapFilterBadValue(t *testing.T) {
 	}
 }
 
+func TestMapFilterNotObject(t *testing.T) {
+	f := Value{Data: "name"}
+	jsonBody := map[string]interface{}{"id": 100, "name": "Fred Flintstone"}
+	_, err := f.Apply(jsonBody)
+	assert.EqualError(t, err, "Filter name returned string instead of an object")
+}
+
 func TestMapFilter(t *testing.T) {
 	f := Value{Data: `{"id":"id", "name":"name"}`}
 	body := `{"id": 100, "name": "Fred Flintstone", "age": 56, "state": "NY"}`
@@ -0,0 +1,262 @@
+package governance
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/canonical"
+	"github.com/spf13/viper"
+)
+
+// ManifestName is the entry of the tar file that lists the data dropped by the policy
+const ManifestName = "data_policy.json"
+
+// allFields allows every field of an object type
+const allFields = "*"
+
+// listFields are kept on a list page, the objects in results are checked one by one
+var listFields = []string{"count", "next", "previous", "results"}
+
+var pageFile = regexp.MustCompile(`^.*\d+\.json$`)
+
+// Policy declares the Tower object types and their fields that may leave the host.
+// The policy file is JSON, it maps every allowed object type to its allowed fields,
+// "*" allows all fields e.g. {"types": {"inventory": ["*"], "job_template": ["id", "url", "name"]}}
+type Policy struct {
+	Types  map[string][]string `json:"types"`
+	sha256 string
+}
+
+// Drop records an object or the fields of an object removed by the policy, the values are never recorded
+type Drop struct {
+	Page   string   `json:"page"`
+	Type   string   `json:"type"`
+	URL    string   `json:"url,omitempty"`
+	Object bool     `json:"object,omitempty"` // The whole object was dropped
+	Fields []string `json:"fields,omitempty"` // The fields that were dropped
+}
+
+// Manifest lists everything the policy dropped from the pages of a task
+type Manifest struct {
+	PolicySHA256 string `json:"policy_sha256"`
+	Dropped      []Drop `json:"dropped"`
+}
+
+// Configured loads the policy file named by worker.data_policy_file, nil if none is configured
+func Configured() (*Policy, error) {
+	file := viper.GetString("worker.data_policy_file")
+	if file == "" {
+		return nil, nil
+	}
+	return Load(file)
+}
+
+// Load reads a policy file
+func Load(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the data policy %s %v", file, err)
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("Error parsing the data policy %s %v", file, err)
+	}
+	if len(p.Types) == 0 {
+		return nil, fmt.Errorf("Data policy %s allows no object types", file)
+	}
+	p.sha256 = fmt.Sprintf("%x", sha256.Sum256(b))
+	return p, nil
+}
+
+// Enforcer applies a policy to the pages of a task and records what it drops.
+// All methods of a nil Enforcer are no-ops.
+type Enforcer struct {
+	policy  *Policy
+	mu      sync.Mutex
+	dropped []Drop
+}
+
+// Enforcer creates an enforcer for a single task, nil for a nil policy
+func (p *Policy) Enforcer() *Enforcer {
+	if p == nil {
+		return nil
+	}
+	return &Enforcer{policy: p}
+}
+
+type enforcerKey struct{}
+
+// WithEnforcer returns a ctx for the workers of a task that carries the enforcer
+func WithEnforcer(ctx context.Context, e *Enforcer) context.Context {
+	return context.WithValue(ctx, enforcerKey{}, e)
+}
+
+// FromContext returns the enforcer of the task, nil if no policy is configured
+func FromContext(ctx context.Context) *Enforcer {
+	e, _ := ctx.Value(enforcerKey{}).(*Enforcer)
+	return e
+}
+
+// Apply returns a page without the objects and fields the policy does not allow, the page
+// itself is left unchanged since the workers still read it. The objects in the
+// results of a list page are checked one by one, any other page is a single object. The type of
+// an object is its type field, objects without one take the type of the page from its path
+// e.g. survey_spec for /api/v2/job_templates/7/survey_spec/page1.json.
+func (e *Enforcer) Apply(page string, body map[string]interface{}) map[string]interface{} {
+	if e == nil {
+		return body
+	}
+	pageType := typeFromPath(page)
+	results, ok := body["results"].([]interface{})
+	if !ok {
+		if kept, ok := e.object(page, pageType, body); ok {
+			return kept
+		}
+		return map[string]interface{}{}
+	}
+
+	list, dropped := pick(body, listFields)
+	if len(dropped) > 0 {
+		e.record(Drop{Page: page, Type: pageType, Fields: dropped})
+	}
+	kept := []interface{}{}
+	for _, r := range results {
+		obj, isObject := r.(map[string]interface{})
+		if !isObject {
+			// Values picked by a filter can only be classified by their page
+			if includes(allFields, e.policy.Types[pageType]) {
+				kept = append(kept, r)
+			} else {
+				e.record(Drop{Page: page, Type: pageType, Object: true})
+			}
+			continue
+		}
+		if o, ok := e.object(page, pageType, obj); ok {
+			kept = append(kept, o)
+		}
+	}
+	list["results"] = kept
+	return list
+}
+
+// object removes the fields that are not allowed, false if the type is not allowed at all
+func (e *Enforcer) object(page string, pageType string, obj map[string]interface{}) (map[string]interface{}, bool) {
+	objType, ok := obj["type"].(string)
+	if !ok || objType == "" {
+		objType = pageType
+	}
+	url, _ := obj["url"].(string)
+	fields, ok := e.policy.Types[objType]
+	if !ok {
+		e.record(Drop{Page: page, Type: objType, URL: url, Object: true})
+		return nil, false
+	}
+	if includes(allFields, fields) {
+		return obj, true
+	}
+	kept, dropped := pick(obj, fields)
+	if len(dropped) > 0 {
+		e.record(Drop{Page: page, Type: objType, URL: url, Fields: dropped})
+	}
+	return kept, true
+}
+
+// pick copies the allowed fields of an object and returns the names of the others
+func pick(obj map[string]interface{}, fields []string) (map[string]interface{}, []string) {
+	kept := make(map[string]interface{}, len(obj))
+	var dropped []string
+	for k, v := range obj {
+		if includes(k, fields) {
+			kept[k] = v
+		} else {
+			dropped = append(dropped, k)
+		}
+	}
+	return kept, dropped
+}
+
+func (e *Enforcer) record(d Drop) {
+	sort.Strings(d.Fields)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropped = append(e.dropped, d)
+}
+
+// Manifest returns the drops of all pages, ordered so it only depends on the collected data
+func (e *Enforcer) Manifest() Manifest {
+	if e == nil {
+		return Manifest{}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dropped := append([]Drop{}, e.dropped...)
+	sort.SliceStable(dropped, func(a, b int) bool {
+		if dropped[a].Page != dropped[b].Page {
+			return dropped[a].Page < dropped[b].Page
+		}
+		return dropped[a].URL < dropped[b].URL
+	})
+	return Manifest{PolicySHA256: e.policy.sha256, Dropped: dropped}
+}
+
+// WriteManifest adds the manifest to the pages of the task
+func (e *Enforcer) WriteManifest(write func(name string, b []byte) error) error {
+	if e == nil {
+		return nil
+	}
+	b, err := canonical.Marshal(e.Manifest())
+	if err != nil {
+		return err
+	}
+	return write(ManifestName, b)
+}
+
+// typeFromPath returns the last path segment of a page that is neither an id nor the page file
+// in the singular form used by the type field of Tower e.g. job_template for /api/v2/job_templates/page1.json
+func typeFromPath(page string) string {
+	segments := strings.Split(strings.Trim(path.Clean("/"+page), "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		if s == "" || pageFile.MatchString(s) || s == "response.json" || isID(s) {
+			continue
+		}
+		return singular(s)
+	}
+	return ""
+}
+
+func singular(s string) string {
+	switch {
+	case strings.HasSuffix(s, "ies"):
+		return strings.TrimSuffix(s, "ies") + "y"
+	case strings.HasSuffix(s, "s"):
+		return strings.TrimSuffix(s, "s")
+	}
+	return s
+}
+
+func isID(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func includes(s string, values []string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package governance
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `{"types": {"inventory": ["*"], "job_template": ["id", "type", "url", "name"], "survey_spec": ["name", "spec"]}}`
+
+func writePolicy(t *testing.T, policy string) string {
+	dir, err := ioutil.TempDir("", "governance")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "policy.json")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(policy), 0600))
+	return file
+}
+
+func testEnforcer(t *testing.T) *Enforcer {
+	p, err := Load(writePolicy(t, testPolicy))
+	assert.NoError(t, err)
+	return p.Enforcer()
+}
+
+func decode(t *testing.T, s string) map[string]interface{} {
+	var m map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(s), &m))
+	return m
+}
+
+func TestApplyListPage(t *testing.T) {
+	e := testEnforcer(t)
+	page := decode(t, `{"count": 3, "next": null, "previous": null, "extra": 1, "results": [
+		{"id": 1, "type": "job_template", "url": "/api/v2/job_templates/1/", "name": "jt", "extra_vars": "password: secret"},
+		{"id": 2, "type": "credential", "url": "/api/v2/credentials/2/", "inputs": {"password": "$encrypted$"}},
+		{"id": 3, "type": "job_template", "url": "/api/v2/job_templates/3/", "name": "jt3"}]}`)
+
+	original := decode(t, `{"count": 3, "next": null, "previous": null, "extra": 1, "results": [
+		{"id": 1, "type": "job_template", "url": "/api/v2/job_templates/1/", "name": "jt", "extra_vars": "password: secret"},
+		{"id": 2, "type": "credential", "url": "/api/v2/credentials/2/", "inputs": {"password": "$encrypted$"}},
+		{"id": 3, "type": "job_template", "url": "/api/v2/job_templates/3/", "name": "jt3"}]}`)
+
+	kept := e.Apply("/api/v2/job_templates/page1.json", page)
+	assert.Equal(t, original, page, "The page read by the workers is unchanged")
+	assert.Equal(t, decode(t, `{"count": 3, "next": null, "previous": null, "results": [
+		{"id": 1, "type": "job_template", "url": "/api/v2/job_templates/1/", "name": "jt"},
+		{"id": 3, "type": "job_template", "url": "/api/v2/job_templates/3/", "name": "jt3"}]}`), kept)
+
+	m := e.Manifest()
+	assert.Len(t, m.PolicySHA256, 64)
+	assert.Equal(t, []Drop{
+		{Page: "/api/v2/job_templates/page1.json", Type: "job_template", Fields: []string{"extra"}},
+		{Page: "/api/v2/job_templates/page1.json", Type: "credential", URL: "/api/v2/credentials/2/", Object: true},
+		{Page: "/api/v2/job_templates/page1.json", Type: "job_template", URL: "/api/v2/job_templates/1/", Fields: []string{"extra_vars"}},
+	}, m.Dropped)
+}
+
+func TestApplyUntypedPage(t *testing.T) {
+	e := testEnforcer(t)
+	kept := e.Apply("/api/v2/job_templates/7/survey_spec/page1.json", decode(t, `{"name": "survey", "description": "", "spec": []}`))
+	assert.Equal(t, decode(t, `{"name": "survey", "spec": []}`), kept)
+
+	kept = e.Apply("/api/v2/inventories/page1.json", decode(t, `{"count": 1, "results": [{"id": 4, "variables": "a: 1"}, "filtered"]}`))
+	assert.Equal(t, decode(t, `{"count": 1, "results": [{"id": 4, "variables": "a: 1"}, "filtered"]}`), kept, "All fields of inventories are allowed")
+
+	kept = e.Apply("/api/v2/credential_types/page1.json", decode(t, `{"count": 1, "results": ["filtered"]}`))
+	assert.Equal(t, decode(t, `{"count": 1, "results": []}`), kept)
+
+	kept = e.Apply("/api/v2/jobs/9/response.json", decode(t, `{"id": 9, "type": "job", "artifacts": {}}`))
+	assert.Empty(t, kept)
+}
+
+func TestTypeFromPath(t *testing.T) {
+	assert.Equal(t, "job_template", typeFromPath("/api/v2/job_templates/page1.json"))
+	assert.Equal(t, "inventory", typeFromPath("/api/v2/inventories/page12.json"))
+	assert.Equal(t, "survey_spec", typeFromPath("/api/v2/job_templates/7/survey_spec/page1.json"))
+	assert.Equal(t, "job", typeFromPath("/api/v2/jobs/9/response.json"))
+}
+
+func TestWriteManifest(t *testing.T) {
+	e := testEnforcer(t)
+	e.Apply("/api/v2/credentials/page1.json", decode(t, `{"count": 1, "results": [{"id": 2, "type": "credential", "url": "/api/v2/credentials/2/"}]}`))
+	pages := make(map[string]string)
+	err := e.WriteManifest(func(name string, b []byte) error {
+		pages[name] = string(b)
+		return nil
+	})
+	assert.NoError(t, err)
+	var m Manifest
+	assert.NoError(t, json.Unmarshal([]byte(pages[ManifestName]), &m))
+	assert.Equal(t, []Drop{{Page: "/api/v2/credentials/page1.json", Type: "credential", URL: "/api/v2/credentials/2/", Object: true}}, m.Dropped)
+}
+
+func TestNilEnforcer(t *testing.T) {
+	var e *Enforcer
+	body := map[string]interface{}{"id": 1}
+	assert.Equal(t, body, e.Apply("/api/v2/credentials/page1.json", body))
+	assert.NoError(t, e.WriteManifest(func(string, []byte) error {
+		t.Error("No manifest without a policy")
+		return nil
+	}))
+	assert.Nil(t, FromContext(context.Background()))
+	assert.Nil(t, (*Policy)(nil).Enforcer())
+}
+
+func TestConfigured(t *testing.T) {
+	p, err := Configured()
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	viper.Set("worker.data_policy_file", writePolicy(t, `{"types": {}}`))
+	defer viper.Set("worker.data_policy_file", nil)
+	_, err = Configured()
+	assert.Error(t, err, "A policy that allows nothing is a mistake")
+
+	viper.Set("worker.data_policy_file", writePolicy(t, testPolicy))
+	p, err = Configured()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"*"}, p.Types["inventory"])
+}
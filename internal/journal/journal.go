@@ -0,0 +1,132 @@
+package journal
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Journal records the tasks accepted by the worker on disk so tasks that were
+// in progress when the worker stopped can be found after a restart.
+// All methods of a nil Journal are no-ops.
+type Journal struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// Entry is the journal record of a single task
+type Entry struct {
+	URL           string                 `json:"url"`
+	Phase         string                 `json:"phase"`
+	AcceptedAt    time.Time              `json:"accepted_at"`
+	UpdatedAt     time.Time              `json:"updated_at"`
+	PendingUpdate map[string]interface{} `json:"pending_update,omitempty"` // The last task update that could not be delivered
+}
+
+// Open opens the journal kept in dir, creating the directory if needed
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Journal{dir: dir}, nil
+}
+
+// Record stores the current phase of a task
+func (j *Journal) Record(url string, phase string) error {
+	return j.write(url, func(entry *Entry) { entry.Phase = phase })
+}
+
+// RecordUpdate stores the last update of a task that could not be delivered so it can be sent again
+func (j *Journal) RecordUpdate(url string, data map[string]interface{}) error {
+	return j.write(url, func(entry *Entry) { entry.PendingUpdate = data })
+}
+
+// write changes the entry of a task, the other attributes of an existing entry are kept
+func (j *Journal) write(url string, change func(entry *Entry)) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now().UTC()
+	entry := Entry{URL: url, AcceptedAt: now}
+	if existing, err := j.read(j.path(url)); err == nil {
+		entry = existing
+	}
+	change(&entry)
+	entry.UpdatedAt = now
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := j.path(url) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path(url))
+}
+
+// Remove drops a finished task from the journal
+func (j *Journal) Remove(url string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := os.Remove(j.path(url))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Entries returns all tasks in the journal ordered by the time they were accepted
+func (j *Journal) Entries() ([]Entry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		entry, err := j.read(filepath.Join(j.dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading journal entry %s %v", f.Name(), err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].AcceptedAt.Before(entries[b].AcceptedAt)
+	})
+	return entries, nil
+}
+
+func (j *Journal) read(path string) (Entry, error) {
+	var entry Entry
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(b, &entry)
+	return entry, err
+}
+
+func (j *Journal) path(url string) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(url))))
+}
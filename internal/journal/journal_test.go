@@ -0,0 +1,72 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := Open(filepath.Join(dir, "tasks"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, j.Record("https://example.com/tasks/1", "accepted"))
+	assert.NoError(t, j.Record("https://example.com/tasks/2", "accepted"))
+	assert.NoError(t, j.Record("https://example.com/tasks/1", "running"))
+
+	entries, err := j.Entries()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(entries)) {
+		assert.Equal(t, "https://example.com/tasks/1", entries[0].URL)
+		assert.Equal(t, "running", entries[0].Phase)
+		assert.True(t, !entries[0].UpdatedAt.Before(entries[0].AcceptedAt))
+		assert.Equal(t, "https://example.com/tasks/2", entries[1].URL)
+		assert.Equal(t, "accepted", entries[1].Phase)
+	}
+
+	// a reopened journal sees the same entries
+	j2, err := Open(filepath.Join(dir, "tasks"))
+	assert.NoError(t, err)
+	assert.NoError(t, j2.Remove("https://example.com/tasks/1"))
+	assert.NoError(t, j2.Remove("https://example.com/tasks/3"))
+	entries, err = j2.Entries()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, "https://example.com/tasks/2", entries[0].URL)
+	}
+}
+
+func TestRecordUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, j.Record("https://example.com/tasks/1", "flushing"))
+	assert.NoError(t, j.RecordUpdate("https://example.com/tasks/1", map[string]interface{}{"state": "completed", "status": "ok"}))
+
+	entries, err := j.Entries()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, "flushing", entries[0].Phase, "The phase is kept")
+		assert.Equal(t, map[string]interface{}{"state": "completed", "status": "ok"}, entries[0].PendingUpdate)
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+	assert.NoError(t, j.Record("https://example.com/tasks/1", "accepted"))
+	assert.NoError(t, j.RecordUpdate("https://example.com/tasks/1", map[string]interface{}{}))
+	assert.NoError(t, j.Remove("https://example.com/tasks/1"))
+	entries, err := j.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -46,10 +46,10 @@ func (jw *jsonWriter) Flush() error {
 	return err
 }
 
-// FlushErrors updates the task to completed state with given error messages
-func (jw *jsonWriter) FlushErrors(messages []string) error {
+// FlushErrors updates the task to completed state with the given errors
+func (jw *jsonWriter) FlushErrors(errors []common.JobError) error {
 	msg := map[string]interface{}{
-		"errors": messages,
+		"errors": errors,
 	}
 	err := jw.task.Update(map[string]interface{}{"state": "completed", "status": "error", "output": &msg, "message": "Catalog Worker Ended with errors"})
 	if err != nil {
@@ -57,3 +57,28 @@ func (jw *jsonWriter) FlushErrors(messages []string) error {
 	}
 	return err
 }
+
+// FlushPartial updates the task to completed state with the errors of the jobs that continue on error
+func (jw *jsonWriter) FlushPartial(errors []common.JobError) error {
+	msg := map[string]interface{}{
+		"errors": errors,
+	}
+	err := jw.task.Update(map[string]interface{}{"state": "completed", "status": "partial", "output": &msg, "message": "Catalog Worker Ended with partial results"})
+	if err != nil {
+		jw.glog.Errorf("Error updating task: %v", err)
+	}
+	return err
+}
+
+// Abort updates the task to completed state with the given status
+func (jw *jsonWriter) Abort(status string, message string, errors []common.JobError) error {
+	update := map[string]interface{}{"state": "completed", "status": status, "message": message}
+	if len(errors) > 0 {
+		update["output"] = &map[string]interface{}{"errors": errors}
+	}
+	err := jw.task.Update(update)
+	if err != nil {
+		jw.glog.Errorf("Error updating task: %v", err)
+	}
+	return err
+}
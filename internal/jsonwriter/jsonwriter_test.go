@@ -62,15 +62,48 @@ func TestFlush(t *testing.T) {
 
 func TestFlushError(t *testing.T) {
 	task := new(mockCatalogTask)
+	errors := []common.JobError{{Href: "/api/v2/job_templates", Message: "error 1"}, {Href: "/api/v2/inventories", HTTPStatus: 404, Message: "error 2"}}
 	updateObj := map[string]interface{}{
 		"state":   "completed",
 		"status":  "error",
-		"output":  &map[string]interface{}{"errors": []string{"error 1", "error 2"}},
+		"output":  &map[string]interface{}{"errors": errors},
 		"message": "Catalog Worker Ended with errors",
 	}
 	task.On("Update", updateObj).Return(nil)
 	jwriter := MakeJSONWriter(logger.CtxWithLoggerID(context.Background(), "123"), task)
-	err := jwriter.FlushErrors([]string{"error 1", "error 2"})
+	err := jwriter.FlushErrors(errors)
+
+	task.AssertExpectations(t)
+	assert.NoError(t, err)
+}
+
+func TestFlushPartial(t *testing.T) {
+	task := new(mockCatalogTask)
+	errors := []common.JobError{{Href: "/api/v2/job_templates/5/survey_spec", HTTPStatus: 404, Message: "error 1"}}
+	updateObj := map[string]interface{}{
+		"state":   "completed",
+		"status":  "partial",
+		"output":  &map[string]interface{}{"errors": errors},
+		"message": "Catalog Worker Ended with partial results",
+	}
+	task.On("Update", updateObj).Return(nil)
+	jwriter := MakeJSONWriter(logger.CtxWithLoggerID(context.Background(), "123"), task)
+	err := jwriter.FlushPartial(errors)
+
+	task.AssertExpectations(t)
+	assert.NoError(t, err)
+}
+
+func TestAbort(t *testing.T) {
+	task := new(mockCatalogTask)
+	updateObj := map[string]interface{}{
+		"state":   "completed",
+		"status":  "cancelled",
+		"message": "Catalog Worker was cancelled",
+	}
+	task.On("Update", updateObj).Return(nil)
+	jwriter := MakeJSONWriter(logger.CtxWithLoggerID(context.Background(), "123"), task)
+	err := jwriter.Abort("cancelled", "Catalog Worker was cancelled", nil)
 
 	task.AssertExpectations(t)
 	assert.NoError(t, err)
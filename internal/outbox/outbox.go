@@ -0,0 +1,352 @@
+package outbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/upload"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrTooLarge is returned when an archive alone exceeds the disk limit of the outbox
+var ErrTooLarge = errors.New("Archive exceeds the size limit of the outbox")
+
+// Upload is an archive waiting in the outbox together with the task update sent once it is uploaded
+type Upload struct {
+	ID          string                 `json:"id"`
+	TaskURL     string                 `json:"task_url"`
+	UploadURL   string                 `json:"upload_url"`
+	Metadata    *upload.Metadata       `json:"metadata"`
+	Size        int64                  `json:"size"`
+	Status      string                 `json:"status"`            // The task status after the upload
+	Message     string                 `json:"message"`           // The task message after the upload
+	Output      map[string]interface{} `json:"output"`            // The task output, the response of the upload service is added as ingress
+	Ingress     map[string]interface{} `json:"ingress,omitempty"` // Set once uploaded, only the task update is outstanding
+	QueuedAt    time.Time              `json:"queued_at"`
+	Attempts    int                    `json:"attempts"`
+	NextAttempt time.Time              `json:"next_attempt"`
+}
+
+// Outbox keeps the archives that failed to upload on disk and uploads them again in the
+// background. Uploads older than the maximum age or evicted to stay below the disk limit
+// fail their task. All methods of a nil Outbox are no-ops.
+type Outbox struct {
+	dir      string
+	maxAge   time.Duration
+	maxBytes int64
+	policy   retry.Policy
+	makeTask func(ctx context.Context, url string) catalogtask.CatalogTask
+	mu       sync.Mutex
+	uploads  map[string]*Upload
+	inFlight map[string]bool
+}
+
+// Open opens the outbox kept in dir, creating the directory if needed, and loads the queued uploads
+func Open(dir string, maxAge time.Duration, maxBytes int64, policy retry.Policy) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		dir:      dir,
+		maxAge:   maxAge,
+		maxBytes: maxBytes,
+		policy:   policy,
+		makeTask: catalogtask.MakeCatalogTask,
+		uploads:  make(map[string]*Upload),
+		inFlight: make(map[string]bool),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		u, err := o.read(filepath.Join(dir, f.Name()))
+		if err != nil {
+			log.Errorf("Error reading the queued upload %s %v", f.Name(), err)
+			continue
+		}
+		if _, err := os.Stat(o.archivePath(u.ID)); err != nil {
+			log.Errorf("Archive of the queued upload for task %s is missing %v", u.TaskURL, err)
+			o.removeFiles(u.ID)
+			continue
+		}
+		o.uploads[u.ID] = u
+	}
+	return o, nil
+}
+
+// Add stores the archive produced by write and queues it for upload. The oldest uploads
+// are evicted if the disk limit is exceeded, their tasks fail.
+func (o *Outbox) Add(u Upload, write func(w io.Writer) error) error {
+	if o == nil {
+		return errors.New("No outbox configured")
+	}
+	u.ID = fmt.Sprintf("%x", sha256.Sum256([]byte(u.TaskURL)))[:32]
+	u.QueuedAt = time.Now().UTC()
+	u.Attempts = 1
+	u.NextAttempt = u.QueuedAt.Add(o.policy.Backoff(1, nil))
+
+	tmp := o.archivePath(u.ID) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Stat(tmp)
+		if err == nil {
+			u.Size = info.Size()
+		}
+	}
+	if err == nil && o.maxBytes > 0 && u.Size > o.maxBytes {
+		err = ErrTooLarge
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := os.Rename(tmp, o.archivePath(u.ID)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	o.uploads[u.ID] = &u
+	if err := o.save(&u); err != nil {
+		delete(o.uploads, u.ID)
+		o.removeFiles(u.ID)
+		return err
+	}
+	o.evict()
+	return nil
+}
+
+// evict fails the oldest uploads until the archives fit the disk limit
+func (o *Outbox) evict() {
+	if o.maxBytes <= 0 {
+		return
+	}
+	var total int64
+	for _, u := range o.uploads {
+		total += u.Size
+	}
+	for _, u := range o.queued() {
+		if total <= o.maxBytes {
+			return
+		}
+		if o.inFlight[u.ID] {
+			continue
+		}
+		total -= u.Size
+		o.fail(u, fmt.Sprintf("Upload dropped, the outbox exceeded %d bytes", o.maxBytes))
+	}
+}
+
+// Pending returns the queued uploads, oldest first
+func (o *Outbox) Pending() []Upload {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var pending []Upload
+	for _, u := range o.queued() {
+		pending = append(pending, *u)
+	}
+	return pending
+}
+
+// Run delivers the due uploads every interval until the shutdown
+func (o *Outbox) Run(interval time.Duration, shutdown <-chan struct{}) {
+	if o == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.Deliver(time.Now())
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// Deliver uploads the archives that are due and updates their tasks. Expired uploads fail their task.
+func (o *Outbox) Deliver(now time.Time) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	var due []*Upload
+	for _, u := range o.queued() {
+		if o.inFlight[u.ID] {
+			continue
+		}
+		if o.maxAge > 0 && now.Sub(u.QueuedAt) > o.maxAge {
+			o.fail(u, fmt.Sprintf("Upload expired, it failed for more than %s", o.maxAge))
+			continue
+		}
+		if !now.Before(u.NextAttempt) {
+			o.inFlight[u.ID] = true
+			due = append(due, u)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, u := range due {
+		o.deliver(u, now)
+	}
+}
+
+// deliver uploads a single archive, unless it was uploaded before, and completes its task
+func (o *Outbox) deliver(u *Upload, now time.Time) {
+	ctx := logger.CtxWithLoggerID(context.Background(), "outbox")
+	glog := logger.GetLogger(ctx)
+	done := false
+	defer func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		delete(o.inFlight, u.ID)
+		if done {
+			delete(o.uploads, u.ID)
+			o.removeFiles(u.ID)
+			return
+		}
+		u.Attempts++
+		u.NextAttempt = now.Add(o.policy.Backoff(u.Attempts, nil))
+		if err := o.save(u); err != nil {
+			glog.Errorf("Error saving the queued upload of task %s %v", u.TaskURL, err)
+		}
+	}()
+
+	if u.Ingress == nil {
+		glog.Infof("Uploading the queued archive of task %s, attempt %d", u.TaskURL, u.Attempts+1)
+		b, err := o.upload(u)
+		if err != nil {
+			glog.Errorf("Error uploading the queued archive of task %s %v", u.TaskURL, err)
+			if !upload.Retryable(err) {
+				o.updateTask(u.TaskURL, "error", "Failed to upload the queued tar file "+err.Error())
+				done = true
+			}
+			return
+		}
+		var ingress map[string]interface{}
+		if err := json.Unmarshal(b, &ingress); err != nil {
+			glog.Errorf("Error unmarshaling the upload response of task %s %v", u.TaskURL, err)
+			o.updateTask(u.TaskURL, "error", "Failed to unmarshal the body of uploading API call")
+			done = true
+			return
+		}
+		u.Ingress = ingress
+	}
+
+	output := make(map[string]interface{})
+	for k, v := range u.Output {
+		output[k] = v
+	}
+	output["ingress"] = u.Ingress
+	err := o.makeTask(ctx, u.TaskURL).Update(map[string]interface{}{"state": "completed", "status": u.Status, "output": output, "message": u.Message})
+	if err != nil {
+		glog.Errorf("Error updating task %s after the queued upload %v", u.TaskURL, err)
+		return
+	}
+	glog.Infof("Queued archive of task %s delivered", u.TaskURL)
+	done = true
+}
+
+// upload sends the queued archive of u, in chunks if resumable uploads are enabled
+func (o *Outbox) upload(u *Upload) ([]byte, error) {
+	file, err := os.Open(o.archivePath(u.ID))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the queued archive %v", err)
+	}
+	defer file.Close()
+	return upload.UploadAt(u.UploadURL, file, u.Size, "", u.Metadata)
+}
+
+// fail drops an upload and fails its task, the caller holds the lock
+func (o *Outbox) fail(u *Upload, message string) {
+	log.Errorf("Task %s failed: %s", u.TaskURL, message)
+	delete(o.uploads, u.ID)
+	o.removeFiles(u.ID)
+	go o.updateTask(u.TaskURL, "error", message)
+}
+
+func (o *Outbox) updateTask(url string, status string, message string) {
+	ctx := logger.CtxWithLoggerID(context.Background(), "outbox")
+	err := o.makeTask(ctx, url).Update(map[string]interface{}{"state": "completed", "status": status, "message": message})
+	if err != nil {
+		log.Errorf("Error updating task %s %v", url, err)
+	}
+}
+
+// queued returns the uploads oldest first, the caller holds the lock
+func (o *Outbox) queued() []*Upload {
+	uploads := make([]*Upload, 0, len(o.uploads))
+	for _, u := range o.uploads {
+		uploads = append(uploads, u)
+	}
+	sort.Slice(uploads, func(a, b int) bool {
+		return uploads[a].QueuedAt.Before(uploads[b].QueuedAt)
+	})
+	return uploads
+}
+
+func (o *Outbox) save(u *Upload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := o.entryPath(u.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.entryPath(u.ID))
+}
+
+func (o *Outbox) read(path string) (*Upload, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	u := &Upload{}
+	err = json.Unmarshal(b, u)
+	return u, err
+}
+
+func (o *Outbox) removeFiles(id string) {
+	os.Remove(o.entryPath(id))
+	os.Remove(o.archivePath(id))
+}
+
+func (o *Outbox) entryPath(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+func (o *Outbox) archivePath(id string) string {
+	return filepath.Join(o.dir, id+".tgz")
+}
@@ -0,0 +1,204 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
+)
+
+// taskRecorder records the updates of all tasks
+type taskRecorder struct {
+	mu      sync.Mutex
+	updates map[string][]map[string]interface{}
+	fail    bool
+}
+
+type recordedTask struct {
+	url      string
+	recorder *taskRecorder
+}
+
+func (rt *recordedTask) Get() (*common.CatalogInventoryTask, error) { return nil, nil }
+
+func (rt *recordedTask) Update(data map[string]interface{}) error {
+	rt.recorder.mu.Lock()
+	defer rt.recorder.mu.Unlock()
+	if rt.recorder.fail {
+		return errors.New("Task unreachable")
+	}
+	rt.recorder.updates[rt.url] = append(rt.recorder.updates[rt.url], data)
+	return nil
+}
+
+func (tr *taskRecorder) recorded(url string) []map[string]interface{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]map[string]interface{}(nil), tr.updates[url]...)
+}
+
+func (tr *taskRecorder) setFail(fail bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.fail = fail
+}
+
+func openTestOutbox(t *testing.T, maxAge time.Duration, maxBytes int64) (*Outbox, *taskRecorder) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	o, err := Open(dir, maxAge, maxBytes, retry.Policy{})
+	assert.NoError(t, err)
+	tr := &taskRecorder{updates: make(map[string][]map[string]interface{})}
+	o.makeTask = func(ctx context.Context, url string) catalogtask.CatalogTask {
+		return &recordedTask{url: url, recorder: tr}
+	}
+	return o, tr
+}
+
+func archive(data string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write([]byte(data))
+		return err
+	}
+}
+
+// uploadServer fails the first failures uploads with 503
+func uploadServer(failures int32) (*httptest.Server, *int32) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"request_id": "42"}`))
+	}))
+	return ts, &calls
+}
+
+func TestDeliver(t *testing.T) {
+	ts, calls := uploadServer(1)
+	defer ts.Close()
+	o, tr := openTestOutbox(t, time.Hour, 1024)
+
+	err := o.Add(Upload{
+		TaskURL:   "https://example.com/tasks/1",
+		UploadURL: ts.URL,
+		Status:    "ok",
+		Message:   "Catalog Worker Completed Successfully",
+		Output:    map[string]interface{}{"sha256": "abc"},
+	}, archive("inventory"))
+	assert.NoError(t, err)
+	pending := o.Pending()
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, int64(9), pending[0].Size)
+	}
+
+	o.Deliver(time.Now())
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	pending = o.Pending()
+	if assert.Equal(t, 1, len(pending), "Still queued after a failed attempt") {
+		assert.Equal(t, 2, pending[0].Attempts)
+	}
+	assert.Empty(t, tr.recorded("https://example.com/tasks/1"))
+
+	o.Deliver(time.Now())
+	assert.Empty(t, o.Pending())
+	updates := tr.recorded("https://example.com/tasks/1")
+	if assert.Equal(t, 1, len(updates)) {
+		assert.Equal(t, "completed", updates[0]["state"])
+		assert.Equal(t, "ok", updates[0]["status"])
+		assert.Equal(t, map[string]interface{}{"sha256": "abc", "ingress": map[string]interface{}{"request_id": "42"}}, updates[0]["output"])
+	}
+	files, err := ioutil.ReadDir(o.dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files, "Delivered archive is removed")
+}
+
+func TestDeliverTaskUnreachable(t *testing.T) {
+	ts, calls := uploadServer(0)
+	defer ts.Close()
+	o, tr := openTestOutbox(t, time.Hour, 1024)
+	assert.NoError(t, o.Add(Upload{TaskURL: "https://example.com/tasks/1", UploadURL: ts.URL, Status: "ok"}, archive("inventory")))
+
+	tr.setFail(true)
+	o.Deliver(time.Now())
+	pending := o.Pending()
+	if assert.Equal(t, 1, len(pending)) {
+		assert.NotNil(t, pending[0].Ingress, "Uploaded, only the task update is outstanding")
+	}
+
+	tr.setFail(false)
+	o.Deliver(time.Now())
+	assert.Empty(t, o.Pending())
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls), "The archive is uploaded once")
+	assert.Equal(t, 1, len(tr.recorded("https://example.com/tasks/1")))
+}
+
+func TestDeliverExpired(t *testing.T) {
+	ts, calls := uploadServer(0)
+	defer ts.Close()
+	o, tr := openTestOutbox(t, time.Hour, 1024)
+	assert.NoError(t, o.Add(Upload{TaskURL: "https://example.com/tasks/1", UploadURL: ts.URL, Status: "ok"}, archive("inventory")))
+
+	o.Deliver(time.Now().Add(2 * time.Hour))
+	assert.Empty(t, o.Pending())
+	assert.Equal(t, int32(0), atomic.LoadInt32(calls))
+	assert.Eventually(t, func() bool { return len(tr.recorded("https://example.com/tasks/1")) == 1 }, time.Second, 10*time.Millisecond)
+	update := tr.recorded("https://example.com/tasks/1")[0]
+	assert.Equal(t, "error", update["status"])
+	assert.Contains(t, update["message"], "Upload expired")
+}
+
+func TestAddEvictsOldest(t *testing.T) {
+	o, tr := openTestOutbox(t, time.Hour, 16)
+	assert.NoError(t, o.Add(Upload{TaskURL: "https://example.com/tasks/1"}, archive("0123456789")))
+	assert.NoError(t, o.Add(Upload{TaskURL: "https://example.com/tasks/2"}, archive("0123456789")))
+
+	pending := o.Pending()
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, "https://example.com/tasks/2", pending[0].TaskURL)
+	}
+	assert.Eventually(t, func() bool { return len(tr.recorded("https://example.com/tasks/1")) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Contains(t, tr.recorded("https://example.com/tasks/1")[0]["message"], "Upload dropped")
+
+	err := o.Add(Upload{TaskURL: "https://example.com/tasks/3"}, archive("01234567890123456789"))
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Equal(t, 1, len(o.Pending()))
+}
+
+func TestReopen(t *testing.T) {
+	o, _ := openTestOutbox(t, time.Hour, 1024)
+	assert.NoError(t, o.Add(Upload{TaskURL: "https://example.com/tasks/1", Status: "partial"}, archive("inventory")))
+
+	reopened, err := Open(o.dir, time.Hour, 1024, retry.Policy{})
+	assert.NoError(t, err)
+	pending := reopened.Pending()
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, "https://example.com/tasks/1", pending[0].TaskURL)
+		assert.Equal(t, "partial", pending[0].Status)
+	}
+}
+
+func TestNilOutbox(t *testing.T) {
+	var o *Outbox
+	assert.Error(t, o.Add(Upload{}, archive("inventory")))
+	assert.Empty(t, o.Pending())
+	o.Deliver(time.Now())
+	o.Run(time.Second, nil)
+}
@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultRequestsPerSecond = 20
+	defaultBurst             = 20
+	// minRateDivisor bounds how far throttling can lower the rate
+	minRateDivisor = 16
+	// recoverySteps is the number of successful calls needed to climb back to the configured rate
+	recoverySteps = 20
+)
+
+// Limiter is a token bucket rate limiter that adapts to the server load.
+// The rate is halved every time the server signals it is overloaded and
+// recovers gradually with every successful call. A nil Limiter does not limit.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64 // Configured requests per second
+	current float64 // Requests per second after adapting to the server load
+	burst   float64
+	tokens  float64
+	last    time.Time
+}
+
+// MakeLimiter creates a Limiter allowing requestsPerSecond with bursts of up to burst requests.
+// It returns nil, meaning unlimited, when requestsPerSecond is not positive.
+func MakeLimiter(requestsPerSecond float64, burst int) *Limiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    requestsPerSecond,
+		current: requestsPerSecond,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// MakeLimiterFromConfig reads the limiter settings from the config section e.g. worker.rate_limit
+func MakeLimiterFromConfig(section string) *Limiter {
+	rps := float64(defaultRequestsPerSecond)
+	if viper.IsSet(section + ".requests_per_second") {
+		rps = viper.GetFloat64(section + ".requests_per_second")
+	}
+	burst := defaultBurst
+	if viper.IsSet(section + ".burst") {
+		burst = viper.GetInt(section + ".burst")
+	}
+	return MakeLimiter(rps, burst)
+}
+
+// Wait blocks until a request is allowed. It returns false if cancel is closed while waiting.
+func (l *Limiter) Wait(cancel <-chan struct{}) bool {
+	d := l.reserve()
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// reserve takes a token and returns how long to wait before it can be used
+func (l *Limiter) reserve() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.current
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.current * float64(time.Second))
+}
+
+// Throttled halves the rate after the server responded with 429 or 503
+func (l *Limiter) Throttled() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current /= 2
+	if floor := l.rate / minRateDivisor; l.current < floor {
+		l.current = floor
+	}
+	// Drop the saved up burst so the lower rate takes effect immediately
+	if l.tokens > 0 {
+		l.tokens = 0
+	}
+}
+
+// Succeeded raises a throttled rate back towards the configured rate
+func (l *Limiter) Succeeded() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current < l.rate {
+		l.current += l.rate / recoverySteps
+		if l.current > l.rate {
+			l.current = l.rate
+		}
+	}
+}
+
+// Rate returns the current requests per second
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	assert.Nil(t, MakeLimiter(0, 10))
+	assert.True(t, l.Wait(nil))
+	l.Throttled()
+	l.Succeeded()
+	assert.Equal(t, float64(0), l.Rate())
+}
+
+func TestMakeLimiterFromConfig(t *testing.T) {
+	l := MakeLimiterFromConfig("test_missing.rate_limit")
+	assert.Equal(t, float64(defaultRequestsPerSecond), l.Rate())
+	assert.Equal(t, float64(defaultBurst), l.burst)
+
+	viper.Set("test.rate_limit.requests_per_second", 5)
+	viper.Set("test.rate_limit.burst", 2)
+	l = MakeLimiterFromConfig("test.rate_limit")
+	assert.Equal(t, float64(5), l.Rate())
+	assert.Equal(t, float64(2), l.burst)
+
+	viper.Set("test.rate_limit.requests_per_second", 0)
+	assert.Nil(t, MakeLimiterFromConfig("test.rate_limit"))
+}
+
+func TestWait(t *testing.T) {
+	l := MakeLimiter(50, 2)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		assert.True(t, l.Wait(nil))
+	}
+	// 2 requests come out of the burst and the other 2 take 20ms each
+	assert.True(t, time.Since(start) >= 35*time.Millisecond, "Waited only %v", time.Since(start))
+}
+
+func TestWaitCancelled(t *testing.T) {
+	l := MakeLimiter(1, 1)
+	assert.True(t, l.Wait(nil))
+	cancel := make(chan struct{})
+	close(cancel)
+	assert.False(t, l.Wait(cancel))
+}
+
+func TestAdaptiveRate(t *testing.T) {
+	l := MakeLimiter(16, 1)
+	l.Throttled()
+	assert.Equal(t, float64(8), l.Rate())
+	for i := 0; i < 10; i++ {
+		l.Throttled()
+	}
+	assert.Equal(t, float64(1), l.Rate(), "Rate should not drop below the minimum")
+
+	for i := 0; i < recoverySteps; i++ {
+		l.Succeeded()
+	}
+	assert.Equal(t, float64(16), l.Rate(), "Rate should recover to the configured rate")
+}
@@ -0,0 +1,91 @@
+package request
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/spf13/viper"
+)
+
+const defaultCancelPollMS = 30000
+
+// cancelPollInterval is the time between checks of the task state for a cancellation
+// requested in the cloud, polling is disabled if it is not positive
+func cancelPollInterval() time.Duration {
+	if viper.IsSet("worker.cancel_poll_interval_ms") {
+		return time.Duration(viper.GetInt64("worker.cancel_poll_interval_ms")) * time.Millisecond
+	}
+	return defaultCancelPollMS * time.Millisecond
+}
+
+// cancelRequested reports if the cloud asked to cancel the task
+func cancelRequested(t *common.CatalogInventoryTask) bool {
+	return t != nil && t.State == "cancelled"
+}
+
+// cloudCancel cancels the ctx of a task on request of the cloud and remembers it,
+// so the task is not reported as cancelled by a shutdown of the worker
+type cloudCancel struct {
+	glog       logger.Logger
+	cancel     context.CancelFunc
+	cancelJobs func() // marks the monitored Tower jobs to be cancelled with the ctx
+	towerJobs  bool   // worker.cancel_tower_jobs
+	requested  int32
+}
+
+func makeCloudCancel(glog logger.Logger, cancel context.CancelFunc, cancelJobs func()) *cloudCancel {
+	return &cloudCancel{glog: glog, cancel: cancel, cancelJobs: cancelJobs, towerJobs: viper.GetBool("worker.cancel_tower_jobs")}
+}
+
+func (cc *cloudCancel) request(reason string) {
+	cc.glog.Infof("Task cancellation requested, %s", reason)
+	atomic.StoreInt32(&cc.requested, 1)
+	if cc.towerJobs {
+		cc.cancelJobs()
+	}
+	cc.cancel()
+}
+
+func (cc *cloudCancel) wasRequested() bool {
+	return atomic.LoadInt32(&cc.requested) == 1
+}
+
+// pollCancellation checks the task state every interval until the ctx is done
+// and calls cancel once the cloud asks to cancel the task
+func pollCancellation(ctx context.Context, glog logger.Logger, task catalogtask.CatalogTask, interval time.Duration, cancel func(reason string)) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t, err := task.Get()
+			if err != nil {
+				glog.Errorf("Error checking the task for a cancellation %v", err)
+				continue
+			}
+			if cancelRequested(t) {
+				cancel("the task state is " + t.State)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// cancelTask handles a cancel message received by a listener
+func cancelTask(ctx context.Context, url string) {
+	glog := logger.GetLogger(ctx)
+	if !registry.cancel(url) {
+		glog.Infof("Task %s is not running, ignoring the cancel message", url)
+		return
+	}
+	glog.Infof("Task %s cancel message received", url)
+}
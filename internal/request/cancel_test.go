@@ -0,0 +1,79 @@
+package request
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+)
+
+// cancellingTask is cancelled in the cloud after it was read cancelAfter times
+type cancellingTask struct {
+	fakeCatalogTask
+	cancelAfter int32
+	gets        int32
+}
+
+func (ct *cancellingTask) Get() (*common.CatalogInventoryTask, error) {
+	t, err := ct.fakeCatalogTask.Get()
+	if atomic.AddInt32(&ct.gets, 1) > ct.cancelAfter {
+		t.State = "cancelled"
+	}
+	return t, err
+}
+
+func (ct *cancellingTask) Update(data map[string]interface{}) error {
+	return nil
+}
+
+func TestProcessRequestCancelPolled(t *testing.T) {
+	viper.Set("worker.cancel_poll_interval_ms", 5)
+	defer viper.Set("worker.cancel_poll_interval_ms", nil)
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &blockingHandler{}, &cancellingTask{cancelAfter: 2}, &pwf, make(chan struct{}))
+	assert.Equal(t, "cancelled", pwf.pw.abortStatus)
+	assert.Equal(t, "Catalog Worker was cancelled on request", pwf.pw.abortMessage)
+}
+
+func TestProcessRequestCancelMessage(t *testing.T) {
+	url := "cancelled_task"
+	registry.begin(url)
+	defer registry.finish(url)
+	cancelTask(logger.CtxWithLoggerID(context.Background(), "123"), url)
+
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), url, &common.CatalogConfig{}, &blockingHandler{}, &fakeCatalogTask{}, &pwf, make(chan struct{}))
+	assert.Equal(t, "cancelled", pwf.pw.abortStatus)
+	assert.Equal(t, "Catalog Worker was cancelled on request", pwf.pw.abortMessage)
+}
+
+func TestProcessRequestCancelledBeforeStart(t *testing.T) {
+	fh := fakeHandler{}
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &fh, &cancellingTask{}, &pwf, make(chan struct{}))
+	assert.Equal(t, "cancelled", pwf.pw.abortStatus)
+	assert.Equal(t, uint32(0), fh.timesCalled, "No worker should be started")
+}
+
+func TestCloudCancelTowerJobs(t *testing.T) {
+	for _, towerJobs := range []bool{false, true} {
+		cancelled := 0
+		jobsCancelled := 0
+		viper.Set("worker.cancel_tower_jobs", towerJobs)
+		cc := makeCloudCancel(logger.GetLogger(logger.CtxWithLoggerID(context.Background(), "123")), func() { cancelled++ }, func() { jobsCancelled++ })
+		cc.request("test")
+		assert.True(t, cc.wasRequested())
+		assert.Equal(t, 1, cancelled)
+		if towerJobs {
+			assert.Equal(t, 1, jobsCancelled)
+		} else {
+			assert.Equal(t, 0, jobsCancelled, "Tower jobs are only cancelled when configured")
+		}
+	}
+	viper.Set("worker.cancel_tower_jobs", nil)
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/build"
-	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
@@ -17,8 +16,12 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+// duplicateHeader is set in the response header when the task was already delivered
+const duplicateHeader = "catalog-task-duplicate"
+
 type catalogServerImpl struct {
 	pb.UnimplementedWorkerServer
 	config     *common.CatalogConfig
@@ -41,9 +44,19 @@ func (s *catalogServerImpl) Send(ctx context.Context, in *pb.Data) (*pb.Receipt,
 		return nil, fmt.Errorf("Payload does not contain an URL")
 	}
 	url := fmt.Sprintf("%v", urlObj)
-	nextCtx := logger.CtxWithLoggerID(ctx, in.MessageId)
+	// The task outlives the call, the call context is cancelled once the receipt is sent
+	nextCtx := logger.CtxWithLoggerID(context.Background(), in.MessageId)
 	logger.GetLogger(nextCtx).Infof("Request payload: %v", payload)
-	go processRequest(nextCtx, url, s.config, s.wokHandler, catalogtask.MakeCatalogTask(nextCtx, url), &defaultPageWriterFactory{}, s.shutdown)
+	if payload["cancel"] == true {
+		cancelTask(nextCtx, url)
+		return &pb.Receipt{}, nil
+	}
+	if !startRequest(nextCtx, url, s.config, s.wokHandler, s.shutdown) {
+		// The receipt has no fields, flag the duplicate in the response header
+		if err := grpc.SetHeader(ctx, metadata.Pairs(duplicateHeader, "true")); err != nil {
+			log.Errorf("Failed to set the duplicate header %v", err)
+		}
+	}
 
 	return &pb.Receipt{}, nil
 }
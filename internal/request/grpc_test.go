@@ -0,0 +1,64 @@
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
+)
+
+// sleepingHandler finishes every job after a short delay unless it is cancelled first
+type sleepingHandler struct{}
+
+func (sh *sleepingHandler) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc towerapiworker.WorkChannels) error {
+	select {
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestSendOutlivesTheCall(t *testing.T) {
+	updates := make(chan map[string]interface{}, 10)
+	task := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			update := map[string]interface{}{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&update))
+			updates <- update
+			w.Write([]byte("{}"))
+			return
+		}
+		w.Write([]byte(`{"id": "1", "state": "pending", "input": {"response_format": "json", "jobs": [{"method": "get", "href_slug": "/api/v2/inventories/"}]}}`))
+	}))
+	defer task.Close()
+
+	s := &catalogServerImpl{config: &common.CatalogConfig{}, wokHandler: &sleepingHandler{}, shutdown: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := s.Send(ctx, &pb.Data{MessageId: "123", Payload: []byte(`{"URL": "` + task.URL + `"}`)})
+	// gRPC cancels the call context once the receipt is sent
+	cancel()
+	assert.NoError(t, err)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case update := <-updates:
+			if update["state"] != "completed" {
+				continue
+			}
+			assert.Equal(t, "ok", update["status"], "The task should not be cancelled with the call")
+			return
+		case <-timeout:
+			t.Fatal("The task was not completed")
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package request
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/spf13/viper"
+)
+
+const defaultProgressIntervalMS = 30000
+
+// progress counts the work done for a task
+type progress struct {
+	jobsDispatched int64
+	jobsFinished   int64
+	pages          int64
+	bytes          int64
+	errors         int64
+	mu             sync.Mutex
+	phase          string
+}
+
+func (p *progress) setPhase(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+}
+
+func (p *progress) snapshot() map[string]interface{} {
+	p.mu.Lock()
+	phase := p.phase
+	p.mu.Unlock()
+	return map[string]interface{}{
+		"phase":           phase,
+		"jobs_dispatched": atomic.LoadInt64(&p.jobsDispatched),
+		"jobs_finished":   atomic.LoadInt64(&p.jobsFinished),
+		"pages":           atomic.LoadInt64(&p.pages),
+		"bytes":           atomic.LoadInt64(&p.bytes),
+		"errors":          atomic.LoadInt64(&p.errors),
+	}
+}
+
+func (p *progress) String() string {
+	s := p.snapshot()
+	return fmt.Sprintf("Catalog Worker %s, %d of %d jobs finished, %d pages, %d bytes, %d errors",
+		s["phase"], s["jobs_finished"], s["jobs_dispatched"], s["pages"], s["bytes"], s["errors"])
+}
+
+// heartbeatTask sends the progress of a running task periodically. The page writer
+// updates the task through it so no heartbeat is sent after the task is completed.
+type heartbeatTask struct {
+	catalogtask.CatalogTask
+	progress  *progress
+	glog      logger.Logger
+	mu        sync.Mutex
+	completed bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+func makeHeartbeatTask(glog logger.Logger, task catalogtask.CatalogTask) *heartbeatTask {
+	return &heartbeatTask{CatalogTask: task, progress: &progress{phase: "collecting"}, glog: glog, stop: make(chan struct{})}
+}
+
+// progressInterval is the time between heartbeats, heartbeats are disabled if it is not positive
+func progressInterval() time.Duration {
+	if viper.IsSet("worker.progress_interval_ms") {
+		return time.Duration(viper.GetInt64("worker.progress_interval_ms")) * time.Millisecond
+	}
+	return defaultProgressIntervalMS * time.Millisecond
+}
+
+// Update forwards an update of the page writer and ends the heartbeats once the task is completed
+func (ht *heartbeatTask) Update(data map[string]interface{}) error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if data["state"] == "completed" {
+		ht.completed = true
+	}
+	return ht.CatalogTask.Update(data)
+}
+
+// start sends heartbeats until the task is completed or stopHeartbeats is called
+func (ht *heartbeatTask) start() {
+	interval := progressInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !ht.beat() {
+					return
+				}
+			case <-ht.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (ht *heartbeatTask) stopHeartbeats() {
+	ht.stopOnce.Do(func() { close(ht.stop) })
+}
+
+// beat sends the current progress, it returns false once the task is completed
+func (ht *heartbeatTask) beat() bool {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if ht.completed {
+		return false
+	}
+	err := ht.CatalogTask.Update(map[string]interface{}{
+		"state":    "running",
+		"message":  ht.progress.String(),
+		"progress": ht.progress.snapshot(),
+	})
+	if err != nil {
+		ht.glog.Errorf("Error sending the task progress %v", err)
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package request
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+)
+
+// updateRecorder records the task updates
+type updateRecorder struct {
+	mu      sync.Mutex
+	updates []map[string]interface{}
+}
+
+func (ur *updateRecorder) Get() (*common.CatalogInventoryTask, error) { return nil, nil }
+
+func (ur *updateRecorder) Update(data map[string]interface{}) error {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.updates = append(ur.updates, data)
+	return nil
+}
+
+func (ur *updateRecorder) recorded() []map[string]interface{} {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	return append([]map[string]interface{}(nil), ur.updates...)
+}
+
+func TestProgress(t *testing.T) {
+	p := &progress{phase: "collecting"}
+	atomic.AddInt64(&p.jobsDispatched, 3)
+	atomic.AddInt64(&p.jobsFinished, 1)
+	atomic.AddInt64(&p.pages, 2)
+	atomic.AddInt64(&p.bytes, 2048)
+	atomic.AddInt64(&p.errors, 1)
+
+	assert.Equal(t, "Catalog Worker collecting, 1 of 3 jobs finished, 2 pages, 2048 bytes, 1 errors", p.String())
+	assert.Equal(t, map[string]interface{}{
+		"phase":           "collecting",
+		"jobs_dispatched": int64(3),
+		"jobs_finished":   int64(1),
+		"pages":           int64(2),
+		"bytes":           int64(2048),
+		"errors":          int64(1),
+	}, p.snapshot())
+}
+
+func TestHeartbeatStopsWhenCompleted(t *testing.T) {
+	viper.Set("worker.progress_interval_ms", 5)
+	defer viper.Set("worker.progress_interval_ms", nil)
+	ur := &updateRecorder{}
+	ht := makeHeartbeatTask(logger.GetLogger(logger.CtxWithLoggerID(context.Background(), "123")), ur)
+	defer ht.stopHeartbeats()
+	ht.start()
+
+	assert.Eventually(t, func() bool { return len(ur.recorded()) >= 2 }, time.Second, 5*time.Millisecond)
+	assert.NoError(t, ht.Update(map[string]interface{}{"state": "completed", "status": "ok"}))
+	time.Sleep(20 * time.Millisecond)
+
+	updates := ur.recorded()
+	last := updates[len(updates)-1]
+	assert.Equal(t, "completed", last["state"], "No heartbeat after the task is completed")
+	assert.Equal(t, "running", updates[0]["state"])
+	assert.NotNil(t, updates[0]["progress"])
+}
+
+func TestHeartbeatDisabled(t *testing.T) {
+	viper.Set("worker.progress_interval_ms", 0)
+	defer viper.Set("worker.progress_interval_ms", nil)
+	ur := &updateRecorder{}
+	ht := makeHeartbeatTask(logger.GetLogger(logger.CtxWithLoggerID(context.Background(), "123")), ur)
+	defer ht.stopHeartbeats()
+	ht.start()
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, ur.recorded())
+}
+
+// progressTask records the updates of the task started by fakeCatalogTask
+type progressTask struct {
+	updateRecorder
+}
+
+func (pt *progressTask) Get() (*common.CatalogInventoryTask, error) {
+	return (&fakeCatalogTask{}).Get()
+}
+
+func TestProcessRequestHeartbeats(t *testing.T) {
+	viper.Set("worker.progress_interval_ms", 5)
+	defer viper.Set("worker.progress_interval_ms", nil)
+	pt := &progressTask{}
+	sh := slowHandler{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &sh, pt, &fakePageWriterFactory{}, make(chan struct{}))
+
+	var heartbeats []map[string]interface{}
+	for _, u := range pt.recorded() {
+		if u["progress"] != nil {
+			heartbeats = append(heartbeats, u["progress"].(map[string]interface{}))
+		}
+	}
+	if assert.NotEmpty(t, heartbeats) {
+		assert.Equal(t, "collecting", heartbeats[0]["phase"])
+		assert.Equal(t, int64(2), heartbeats[0]["jobs_dispatched"])
+	}
+}
@@ -0,0 +1,78 @@
+package request
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
+)
+
+// towerIdentity caches the identity of Ansible Tower sent with the uploads, nil if it is not looked up
+var towerIdentity *identityCache
+
+// identityTimeout bounds a lookup of the identity, the task waits for it before it starts
+const identityTimeout = 10 * time.Second
+
+// identityCache looks up the identity of Ansible Tower once it is needed and keeps
+// it after the first successful lookup. All methods of a nil identityCache are no-ops.
+type identityCache struct {
+	config   *common.CatalogConfig
+	fetch    func(ctx context.Context, config *common.CatalogConfig) (towerapiworker.TowerIdentity, error)
+	timeout  time.Duration
+	mu       sync.Mutex
+	identity *towerapiworker.TowerIdentity
+}
+
+func makeIdentityCache(config *common.CatalogConfig) *identityCache {
+	return &identityCache{
+		config: config,
+		fetch: func(ctx context.Context, config *common.CatalogConfig) (towerapiworker.TowerIdentity, error) {
+			return towerapiworker.FetchTowerIdentity(ctx, config, nil)
+		},
+		timeout: identityTimeout,
+	}
+}
+
+// get returns the identity of Ansible Tower, false if it could not be looked up. The lock is
+// not held during a lookup, so a hung Tower only delays the tasks that are looking it up.
+func (c *identityCache) get(ctx context.Context) (towerapiworker.TowerIdentity, bool) {
+	if c == nil {
+		return towerapiworker.TowerIdentity{}, false
+	}
+	c.mu.Lock()
+	cached := c.identity
+	c.mu.Unlock()
+	if cached != nil {
+		return *cached, true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	identity, err := c.fetch(ctx, c.config)
+	if err != nil {
+		logger.GetLogger(ctx).Errorf("Error looking up the identity of Ansible Tower %v", err)
+		return towerapiworker.TowerIdentity{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.identity = &identity
+	return identity, true
+}
+
+// addTowerIdentity adds the uuid and name of Ansible Tower to the upload metadata.
+// Only tar files are uploaded with metadata, other formats skip the lookup.
+func addTowerIdentity(ctx context.Context, responseFormat string, metadata map[string]string) {
+	switch strings.ToLower(responseFormat) {
+	case "tar", "tar-delta":
+	default:
+		return
+	}
+	if identity, ok := towerIdentity.get(ctx); ok {
+		metadata["tower_uuid"] = identity.UUID
+		metadata["tower_name"] = identity.Name
+	}
+}
@@ -0,0 +1,105 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
+)
+
+func TestIdentityCache(t *testing.T) {
+	ctx := logger.CtxWithLoggerID(context.Background(), "123")
+	lookups := 0
+	failing := true
+	c := &identityCache{
+		config:  &common.CatalogConfig{},
+		timeout: time.Second,
+		fetch: func(ctx context.Context, config *common.CatalogConfig) (towerapiworker.TowerIdentity, error) {
+			lookups++
+			if failing {
+				return towerapiworker.TowerIdentity{}, errors.New("Tower unreachable")
+			}
+			return towerapiworker.TowerIdentity{UUID: "8ed2ad0c", Name: "tower.example.com"}, nil
+		},
+	}
+
+	_, ok := c.get(ctx)
+	assert.False(t, ok)
+
+	failing = false
+	identity, ok := c.get(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "8ed2ad0c", identity.UUID)
+	_, ok = c.get(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, 2, lookups, "The identity is kept after the first successful lookup")
+
+	var nilCache *identityCache
+	_, ok = nilCache.get(ctx)
+	assert.False(t, ok)
+}
+
+func TestIdentityCacheHungTower(t *testing.T) {
+	ctx := logger.CtxWithLoggerID(context.Background(), "123")
+	var lookups int32
+	c := &identityCache{
+		config:  &common.CatalogConfig{},
+		timeout: 200 * time.Millisecond,
+		fetch: func(ctx context.Context, config *common.CatalogConfig) (towerapiworker.TowerIdentity, error) {
+			if atomic.AddInt32(&lookups, 1) == 1 {
+				// The first lookup hangs until it times out
+				<-ctx.Done()
+				return towerapiworker.TowerIdentity{}, ctx.Err()
+			}
+			return towerapiworker.TowerIdentity{UUID: "8ed2ad0c"}, nil
+		},
+	}
+
+	hung := make(chan bool)
+	go func() {
+		_, ok := c.get(ctx)
+		hung <- ok
+	}()
+	for atomic.LoadInt32(&lookups) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	identity, ok := c.get(ctx)
+	assert.True(t, ok, "A hung lookup does not block the other tasks")
+	assert.Equal(t, "8ed2ad0c", identity.UUID)
+
+	select {
+	case ok := <-hung:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The hung lookup did not time out")
+	}
+}
+
+func TestAddTowerIdentity(t *testing.T) {
+	ctx := logger.CtxWithLoggerID(context.Background(), "123")
+	lookups := 0
+	towerIdentity = &identityCache{
+		config:  &common.CatalogConfig{},
+		timeout: time.Second,
+		fetch: func(ctx context.Context, config *common.CatalogConfig) (towerapiworker.TowerIdentity, error) {
+			lookups++
+			return towerapiworker.TowerIdentity{UUID: "8ed2ad0c", Name: "tower.example.com"}, nil
+		},
+	}
+	defer func() { towerIdentity = nil }()
+
+	metadata := map[string]string{}
+	addTowerIdentity(ctx, "json", metadata)
+	assert.Empty(t, metadata)
+	assert.Equal(t, 0, lookups, "The identity is only looked up for tar files")
+
+	addTowerIdentity(ctx, "tar-delta", metadata)
+	assert.Equal(t, map[string]string{"tower_uuid": "8ed2ad0c", "tower_name": "tower.example.com"}, metadata)
+}
@@ -9,7 +9,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
@@ -78,10 +77,14 @@ func startMQTTListener(config *common.CatalogConfig, wh towerapiworker.WorkHandl
 			log.Errorf("Error decoding mqtt json %v", err)
 			return
 		}
-		log.Infof("Process Request %s", m.URL)
 		counter++
 		nextCtx := logger.CtxWithLoggerID(ctx, strconv.Itoa(counter))
-		go processRequest(nextCtx, m.URL, config, wh, catalogtask.MakeCatalogTask(nextCtx, m.URL), &defaultPageWriterFactory{}, shutdown)
+		if m.Cancel {
+			cancelTask(nextCtx, m.URL)
+			return
+		}
+		log.Infof("Process Request %s", m.URL)
+		startRequest(nextCtx, m.URL, config, wh, shutdown)
 	}
 
 	if token := mqttClient.Subscribe(topic, 0, fn); token.Wait() && token.Error() != nil {
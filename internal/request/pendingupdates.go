@@ -0,0 +1,118 @@
+package request
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/journal"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/tarwriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultResendIntervalMinutes = 5
+
+// journaledTask keeps the final update of a task in the journal when it can't be
+// delivered after all retries, so it is sent again later instead of being lost
+type journaledTask struct {
+	catalogtask.CatalogTask
+	url         string
+	glog        logger.Logger
+	undelivered int32
+	final       int32
+}
+
+func makeJournaledTask(glog logger.Logger, url string, task catalogtask.CatalogTask) *journaledTask {
+	return &journaledTask{CatalogTask: task, url: url, glog: glog}
+}
+
+func (jt *journaledTask) Update(data map[string]interface{}) error {
+	err := jt.CatalogTask.Update(data)
+	if data["status"] == tarwriter.PendingUploadStatus {
+		// The outbox sends the final update, even if this one was not delivered
+		atomic.StoreInt32(&jt.final, 1)
+	}
+	if data["state"] != "completed" {
+		return err
+	}
+	if err == nil {
+		atomic.StoreInt32(&jt.undelivered, 0)
+		atomic.StoreInt32(&jt.final, 1)
+		return nil
+	}
+	if jerr := taskJournal.RecordUpdate(jt.url, data); jerr != nil {
+		jt.glog.Errorf("Error keeping the undelivered task update in the journal %v", jerr)
+		return err
+	}
+	jt.glog.Infof("Task update kept in the journal to be sent again")
+	atomic.StoreInt32(&jt.undelivered, 1)
+	atomic.StoreInt32(&jt.final, 1)
+	return err
+}
+
+// hasUndelivered reports if the final update is waiting in the journal
+func (jt *journaledTask) hasUndelivered() bool {
+	return atomic.LoadInt32(&jt.undelivered) == 1
+}
+
+// hasFinal reports if the final update was delivered, is waiting in the journal or
+// will be sent by the outbox
+func (jt *journaledTask) hasFinal() bool {
+	return atomic.LoadInt32(&jt.final) == 1
+}
+
+// resendInterval is the time between attempts to send the undelivered task updates,
+// they are only sent at the start if it is not positive
+func resendInterval() time.Duration {
+	if viper.IsSet("worker.task_resend_interval_minutes") {
+		return time.Duration(viper.GetInt64("worker.task_resend_interval_minutes")) * time.Minute
+	}
+	return defaultResendIntervalMinutes * time.Minute
+}
+
+// resendUpdates sends the undelivered task updates every interval until the shutdown
+func resendUpdates(j *journal.Journal, makeTask func(ctx context.Context, url string) catalogtask.CatalogTask, interval time.Duration, shutdown chan struct{}) {
+	if j == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sendPendingUpdates(j, makeTask)
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// sendPendingUpdates sends the task updates kept in the journal, the delivered ones are removed
+func sendPendingUpdates(j *journal.Journal, makeTask func(ctx context.Context, url string) catalogtask.CatalogTask) {
+	entries, err := j.Entries()
+	if err != nil {
+		log.Errorf("Error reading the task journal %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.PendingUpdate != nil {
+			deliverUpdate(j, makeTask, entry.URL, entry.PendingUpdate)
+		}
+	}
+}
+
+// deliverUpdate sends a task update and removes the task from the journal once it is delivered
+func deliverUpdate(j *journal.Journal, makeTask func(ctx context.Context, url string) catalogtask.CatalogTask, url string, data map[string]interface{}) bool {
+	ctx := logger.CtxWithLoggerID(context.Background(), "recovery")
+	if err := makeTask(ctx, url).Update(data); err != nil {
+		log.Errorf("Error updating the task %s %v", url, err)
+		return false
+	}
+	if err := j.Remove(url); err != nil {
+		log.Errorf("Error removing task %s from the journal %v", url, err)
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package request
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/journal"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/tarwriter"
+)
+
+// unreachableTask fails all updates after the task was started
+type unreachableTask struct {
+	fakeCatalogTask
+}
+
+func (ut *unreachableTask) Update(data map[string]interface{}) error {
+	if data["state"] == "running" {
+		return nil
+	}
+	return fmt.Errorf("Task unreachable")
+}
+
+// completingPageWriter completes the task through its updates
+type completingPageWriter struct {
+	fakePageWriter
+	task catalogtask.CatalogTask
+}
+
+func (pw *completingPageWriter) Flush() error {
+	return pw.task.Update(map[string]interface{}{"state": "completed", "status": "ok", "message": "done"})
+}
+
+type completingPageWriterFactory struct{}
+
+func (factory *completingPageWriterFactory) makePageWriter(ctx context.Context, input common.RequestInput, task catalogtask.CatalogTask, metadata map[string]string) (common.PageWriter, error) {
+	return &completingPageWriter{task: task}, nil
+}
+
+// queuingPageWriter hands its tar file to the outbox, which completes the task later
+type queuingPageWriter struct {
+	fakePageWriter
+	task catalogtask.CatalogTask
+}
+
+func (pw *queuingPageWriter) Flush() error {
+	return pw.task.Update(map[string]interface{}{"state": "running", "status": tarwriter.PendingUploadStatus})
+}
+
+type queuingPageWriterFactory struct{}
+
+func (factory *queuingPageWriterFactory) makePageWriter(ctx context.Context, input common.RequestInput, task catalogtask.CatalogTask, metadata map[string]string) (common.PageWriter, error) {
+	return &queuingPageWriter{task: task}, nil
+}
+
+func TestProcessRequestQueuedUpload(t *testing.T) {
+	ctx := logger.CtxWithLoggerID(context.Background(), "123")
+	completed := processRequest(ctx, "testurl", &common.CatalogConfig{}, &fakeHandler{}, &fakeCatalogTask{}, &queuingPageWriterFactory{}, make(chan struct{}))
+	assert.True(t, completed, "A redelivery must not run the task again while the outbox uploads its tar file")
+
+	completed = processRequest(ctx, "testurl", &common.CatalogConfig{}, &fakeHandler{}, &fakeCatalogTask{}, &fakePageWriterFactory{}, make(chan struct{}))
+	assert.False(t, completed, "Nothing sends the final update")
+}
+
+func TestProcessRequestUndeliveredUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	taskJournal, err = journal.Open(dir)
+	assert.NoError(t, err)
+	defer func() { taskJournal = nil }()
+
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &fakeHandler{}, &unreachableTask{}, &completingPageWriterFactory{}, make(chan struct{}))
+	entries, err := taskJournal.Entries()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(entries), "The task with the undelivered update is kept in the journal") {
+		assert.Equal(t, "completed", entries[0].PendingUpdate["state"])
+		assert.Equal(t, "ok", entries[0].PendingUpdate["status"])
+	}
+
+	// still unreachable
+	sendPendingUpdates(taskJournal, func(ctx context.Context, url string) catalogtask.CatalogTask {
+		return &recordingTask{url: url, fail: true}
+	})
+	entries, err = taskJournal.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	var updates []map[string]interface{}
+	sendPendingUpdates(taskJournal, func(ctx context.Context, url string) catalogtask.CatalogTask {
+		return &recordingTask{url: url, updates: &updates}
+	})
+	if assert.Equal(t, 1, len(updates)) {
+		assert.Equal(t, "testurl", updates[0]["url"])
+		assert.Equal(t, "done", updates[0]["message"])
+	}
+	entries, err = taskJournal.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "The delivered update is removed from the journal")
+}
+
+func TestRecoverTasksPendingUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	j, err := journal.Open(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, j.Record("https://example.com/tasks/1", "flushing"))
+	assert.NoError(t, j.RecordUpdate("https://example.com/tasks/1", map[string]interface{}{"state": "completed", "status": "ok"}))
+
+	var updates []map[string]interface{}
+	recoverTasks(j, func(ctx context.Context, url string) catalogtask.CatalogTask {
+		return &recordingTask{url: url, updates: &updates}
+	})
+	if assert.Equal(t, 1, len(updates)) {
+		assert.Equal(t, "ok", updates[0]["status"], "The undelivered update is sent instead of an error")
+	}
+	entries, err := j.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,99 @@
+package request
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/spf13/viper"
+)
+
+const defaultMaxConcurrency = 10
+const defaultMaxGlobalConcurrency = 50
+
+// queuedJobs counts jobs waiting for a worker across all requests
+var queuedJobs int64
+
+// runningWorkers counts workers running across all requests
+var runningWorkers int64
+
+// globalSlots is a semaphore limiting the number of workers running across all requests
+var globalSlots chan struct{}
+var globalSlotsOnce sync.Once
+
+// workerPool queues the jobs of a single request and limits how many of them run at the same time.
+// It is owned by the dispatcher goroutine and is not safe for concurrent use.
+type workerPool struct {
+	maxWorkers int
+	running    int
+	queue      []common.JobParam
+}
+
+func makeWorkerPool() *workerPool {
+	maxWorkers := viper.GetInt("worker.max_concurrency")
+	if maxWorkers <= 0 {
+		maxWorkers = defaultMaxConcurrency
+	}
+	return &workerPool{maxWorkers: maxWorkers}
+}
+
+// add queues a job until a worker is available
+func (p *workerPool) add(job common.JobParam) {
+	p.queue = append(p.queue, job)
+	atomic.AddInt64(&queuedJobs, 1)
+}
+
+// next dequeues the next job if the pool has room for another worker
+func (p *workerPool) next() (common.JobParam, bool) {
+	if p.running >= p.maxWorkers || len(p.queue) == 0 {
+		return common.JobParam{}, false
+	}
+	job := p.queue[0]
+	p.queue = p.queue[1:]
+	p.running++
+	atomic.AddInt64(&queuedJobs, -1)
+	return job, true
+}
+
+// done releases the room taken by a finished worker
+func (p *workerPool) done() {
+	p.running--
+}
+
+// idle reports if there are no running workers or queued jobs
+func (p *workerPool) idle() bool {
+	return p.running == 0 && len(p.queue) == 0
+}
+
+// drain drops all queued jobs
+func (p *workerPool) drain() {
+	atomic.AddInt64(&queuedJobs, -int64(len(p.queue)))
+	p.queue = nil
+}
+
+// acquireGlobalSlot blocks until a worker can run without exceeding the global concurrency.
+// It returns false if cancel is closed while waiting.
+func acquireGlobalSlot(cancel <-chan struct{}) bool {
+	globalSlotsOnce.Do(func() {
+		maxWorkers := viper.GetInt("worker.max_global_concurrency")
+		if maxWorkers <= 0 {
+			maxWorkers = defaultMaxGlobalConcurrency
+		}
+		globalSlots = make(chan struct{}, maxWorkers)
+	})
+
+	atomic.AddInt64(&queuedJobs, 1)
+	defer atomic.AddInt64(&queuedJobs, -1)
+	select {
+	case globalSlots <- struct{}{}:
+		atomic.AddInt64(&runningWorkers, 1)
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+func releaseGlobalSlot() {
+	atomic.AddInt64(&runningWorkers, -1)
+	<-globalSlots
+}
@@ -0,0 +1,44 @@
+package request
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := &workerPool{maxWorkers: 2}
+	assert.True(t, pool.idle())
+
+	for _, slug := range []string{"/api/v2/a", "/api/v2/b", "/api/v2/c"} {
+		pool.add(common.JobParam{HrefSlug: slug})
+	}
+	assert.Equal(t, int64(3), atomic.LoadInt64(&queuedJobs))
+
+	job, ok := pool.next()
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v2/a", job.HrefSlug)
+	job, ok = pool.next()
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v2/b", job.HrefSlug)
+	_, ok = pool.next()
+	assert.False(t, ok, "Pool should be full")
+	assert.Equal(t, int64(1), atomic.LoadInt64(&queuedJobs))
+
+	pool.done()
+	job, ok = pool.next()
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v2/c", job.HrefSlug)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&queuedJobs))
+
+	pool.done()
+	pool.done()
+	assert.True(t, pool.idle())
+
+	pool.add(common.JobParam{HrefSlug: "/api/v2/d"})
+	pool.drain()
+	assert.True(t, pool.idle())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&queuedJobs))
+}
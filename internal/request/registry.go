@@ -0,0 +1,164 @@
+package request
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultRetentionMinutes = 60
+
+// registry tracks the running and the recently completed tasks across all listeners
+var registry = makeTaskRegistry(defaultRetentionMinutes*time.Minute, "")
+
+// taskRegistry remembers the tasks that are running or completed recently so tasks
+// delivered more than once, by MQTT QoS redelivery or rhc retries, are only processed once.
+// The completed tasks are optionally saved to a file to survive restarts.
+type taskRegistry struct {
+	mu        sync.Mutex
+	active    map[string]time.Time
+	cancels   map[string]chan struct{} // closed when the cloud cancels a running task
+	completed map[string]time.Time
+	retention time.Duration
+	path      string
+}
+
+func makeTaskRegistry(retention time.Duration, path string) *taskRegistry {
+	r := &taskRegistry{
+		active:    make(map[string]time.Time),
+		cancels:   make(map[string]chan struct{}),
+		completed: make(map[string]time.Time),
+		retention: retention,
+		path:      path,
+	}
+	r.load()
+	return r
+}
+
+// configureTaskRegistry creates the registry from the worker.dedup config section
+func configureTaskRegistry() *taskRegistry {
+	retention := time.Duration(defaultRetentionMinutes) * time.Minute
+	if viper.IsSet("worker.dedup.retention_minutes") {
+		retention = time.Duration(viper.GetInt64("worker.dedup.retention_minutes")) * time.Minute
+	}
+	path := ""
+	if viper.GetBool("worker.dedup.persist") {
+		path = filepath.Join(common.StateDir(), "completed_tasks.json")
+	}
+	return makeTaskRegistry(retention, path)
+}
+
+// begin marks a task as running. If the task is already running or completed
+// recently it returns false with the state of the earlier delivery.
+func (r *taskRegistry) begin(url string) (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(time.Now())
+	if _, ok := r.active[url]; ok {
+		return false, "running"
+	}
+	if _, ok := r.completed[url]; ok {
+		return false, "completed"
+	}
+	r.active[url] = time.Now()
+	r.cancels[url] = make(chan struct{})
+	return true, ""
+}
+
+// cancelled returns a channel that is closed when the running task is cancelled,
+// it is nil for a task that is not running so it never fires
+func (r *taskRegistry) cancelled(url string) <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cancels[url]
+}
+
+// cancel signals a running task to stop, it returns false if the task is not running
+func (r *taskRegistry) cancel(url string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.cancels[url]
+	if !ok {
+		return false
+	}
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+	return true
+}
+
+// finish marks a running task as completed
+func (r *taskRegistry) finish(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, url)
+	delete(r.cancels, url)
+	r.completed[url] = time.Now()
+	r.save()
+}
+
+// forget drops a running task without marking it completed, a later delivery runs it again
+func (r *taskRegistry) forget(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, url)
+	delete(r.cancels, url)
+}
+
+// prune forgets the tasks that were completed before the retention period
+func (r *taskRegistry) prune(now time.Time) {
+	for url, t := range r.completed {
+		if now.Sub(t) > r.retention {
+			delete(r.completed, url)
+		}
+	}
+}
+
+func (r *taskRegistry) load() {
+	if r.path == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &r.completed)
+	}
+	if err != nil {
+		log.Errorf("Error loading completed tasks from %s %v", r.path, err)
+		r.completed = make(map[string]time.Time)
+		return
+	}
+	r.prune(time.Now())
+}
+
+func (r *taskRegistry) save() {
+	if r.path == "" {
+		return
+	}
+	r.prune(time.Now())
+	b, err := json.Marshal(r.completed)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.path), 0700)
+	}
+	if err == nil {
+		tmp := r.path + ".tmp"
+		err = ioutil.WriteFile(tmp, b, 0600)
+		if err == nil {
+			err = os.Rename(tmp, r.path)
+		}
+	}
+	if err != nil {
+		log.Errorf("Error saving completed tasks to %s %v", r.path, err)
+	}
+}
@@ -0,0 +1,146 @@
+package request
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+)
+
+func TestTaskRegistry(t *testing.T) {
+	r := makeTaskRegistry(time.Hour, "")
+
+	ok, _ := r.begin("task1")
+	assert.True(t, ok)
+	ok, state := r.begin("task1")
+	assert.False(t, ok)
+	assert.Equal(t, "running", state)
+
+	r.finish("task1")
+	ok, state = r.begin("task1")
+	assert.False(t, ok)
+	assert.Equal(t, "completed", state)
+
+	ok, _ = r.begin("task2")
+	assert.True(t, ok)
+
+	r.forget("task2")
+	ok, _ = r.begin("task2")
+	assert.True(t, ok, "A forgotten task runs again")
+}
+
+func TestTaskRegistryRetention(t *testing.T) {
+	r := makeTaskRegistry(time.Hour, "")
+	r.begin("task1")
+	r.finish("task1")
+	r.completed["task1"] = time.Now().Add(-2 * time.Hour)
+
+	ok, _ := r.begin("task1")
+	assert.True(t, ok)
+}
+
+func TestTaskRegistryPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "completed_tasks.json")
+
+	r := makeTaskRegistry(time.Hour, path)
+	r.begin("task1")
+	r.finish("task1")
+	r.begin("task2")
+
+	restarted := makeTaskRegistry(time.Hour, path)
+	ok, state := restarted.begin("task1")
+	assert.False(t, ok)
+	assert.Equal(t, "completed", state)
+	ok, _ = restarted.begin("task2")
+	assert.True(t, ok, "Running tasks are recovered from the journal")
+}
+
+func TestTaskRegistryCorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "completed_tasks.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("not json"), 0600))
+
+	r := makeTaskRegistry(time.Hour, path)
+	ok, _ := r.begin("task1")
+	assert.True(t, ok)
+}
+
+func TestTaskRegistryCancel(t *testing.T) {
+	r := makeTaskRegistry(time.Hour, "")
+	assert.False(t, r.cancel("task1"), "Task is not running")
+	assert.Nil(t, r.cancelled("task1"))
+
+	r.begin("task1")
+	cancelled := r.cancelled("task1")
+	assert.True(t, r.cancel("task1"))
+	assert.True(t, r.cancel("task1"), "Cancelling twice is harmless")
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("Task should be cancelled")
+	}
+
+	r.finish("task1")
+	assert.False(t, r.cancel("task1"), "Task is completed")
+}
+
+// waitUntilDone waits for the task to stop running and returns the state of a new delivery
+func waitUntilDone(t *testing.T, url string) (bool, string) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		registry.mu.Lock()
+		_, running := registry.active[url]
+		registry.mu.Unlock()
+		if !running {
+			ok, state := registry.begin(url)
+			if ok {
+				registry.forget(url)
+			}
+			return ok, state
+		}
+	}
+	t.Fatalf("Task %s is still running", url)
+	return false, ""
+}
+
+func TestStartRequestTaskNotRead(t *testing.T) {
+	task := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer task.Close()
+
+	ctx := logger.CtxWithLoggerID(context.Background(), "123")
+	assert.True(t, startRequest(ctx, task.URL, &common.CatalogConfig{}, &fakeHandler{}, make(chan struct{})))
+	ok, _ := waitUntilDone(t, task.URL)
+	assert.True(t, ok, "A task that was never updated can be delivered again")
+}
+
+func TestStartRequestCompleted(t *testing.T) {
+	task := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			w.Write([]byte("{}"))
+			return
+		}
+		w.Write([]byte(`{"id": "1", "state": "pending", "input": {"response_format": "json", "jobs": [{"method": "get", "href_slug": "/api/v2/inventories/"}]}}`))
+	}))
+	defer task.Close()
+
+	ctx := logger.CtxWithLoggerID(context.Background(), "123")
+	assert.True(t, startRequest(ctx, task.URL, &common.CatalogConfig{}, &sleepingHandler{}, make(chan struct{})))
+	ok, state := waitUntilDone(t, task.URL)
+	assert.False(t, ok)
+	assert.Equal(t, "completed", state)
+}
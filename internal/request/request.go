@@ -5,15 +5,25 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/RedHatInsights/rhc-worker-catalog/build"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/accesspolicy"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/governance"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/journal"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/jsonwriter"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/outbox"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/tarwriter"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
 	log "github.com/sirupsen/logrus"
@@ -34,10 +44,28 @@ type listener interface {
 	stop()
 }
 
+const (
+	defaultOutboxMaxAgeHours     = 24
+	defaultOutboxMaxSizeMB       = 512
+	defaultOutboxIntervalSeconds = 60
+)
+
+// taskJournal records the tasks in progress so they can be recovered after a restart
+var taskJournal *journal.Journal
+
 // StartHandlingRequests starts a request listener. It will not stop until receives a system signal.
 func (drh *DefaultRequestHandler) StartHandlingRequests(config *common.CatalogConfig, wh towerapiworker.WorkHandler) {
+	taskJournal = openTaskJournal()
+	recoverTasks(taskJournal, catalogtask.MakeCatalogTask)
+	registry = configureTaskRegistry()
+	towerIdentity = makeIdentityCache(config)
+
 	sigs := make(chan os.Signal, 1)
 	shutdown := make(chan struct{})
+	go resendUpdates(taskJournal, catalogtask.MakeCatalogTask, resendInterval(), shutdown)
+	uploads := openOutbox()
+	tarwriter.UseOutbox(uploads)
+	go uploads.Run(outboxInterval(), shutdown)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	if _, ok := os.LookupEnv("YGG_SOCKET_ADDR"); ok {
@@ -65,34 +93,175 @@ func (drh *DefaultRequestHandler) StartHandlingRequests(config *common.CatalogCo
 	log.Info("Request listener stopped")
 }
 
-func startDispatcher(ctx context.Context, config *common.CatalogConfig, wc towerapiworker.WorkChannels, pw common.PageWriter, wh towerapiworker.WorkHandler) {
+func openTaskJournal() *journal.Journal {
+	dir := filepath.Join(common.StateDir(), "tasks")
+	j, err := journal.Open(dir)
+	if err != nil {
+		log.Errorf("Error opening the task journal in %s, tasks interrupted by a restart will not be recovered %v", dir, err)
+		return nil
+	}
+	return j
+}
+
+// openOutbox opens the outbox for the tar files that failed to upload, configured in the worker.outbox section
+func openOutbox() *outbox.Outbox {
+	if viper.IsSet("worker.outbox.enabled") && !viper.GetBool("worker.outbox.enabled") {
+		return nil
+	}
+	maxAge := defaultOutboxMaxAgeHours * time.Hour
+	if viper.IsSet("worker.outbox.max_age_hours") {
+		maxAge = time.Duration(viper.GetInt64("worker.outbox.max_age_hours")) * time.Hour
+	}
+	maxSize := int64(defaultOutboxMaxSizeMB)
+	if viper.IsSet("worker.outbox.max_size_mb") {
+		maxSize = viper.GetInt64("worker.outbox.max_size_mb")
+	}
+	policy := retry.MakePolicy("worker.outbox")
+	if !viper.IsSet("worker.outbox.base_backoff_ms") {
+		policy.BaseBackoff = time.Minute
+	}
+	if !viper.IsSet("worker.outbox.max_backoff_ms") {
+		policy.MaxBackoff = time.Hour
+	}
+
+	dir := filepath.Join(common.StateDir(), "outbox")
+	o, err := outbox.Open(dir, maxAge, maxSize*1024*1024, policy)
+	if err != nil {
+		log.Errorf("Error opening the outbox in %s, failed uploads will not be retried %v", dir, err)
+		return nil
+	}
+	return o
+}
+
+// outboxInterval is the time between attempts to deliver the queued uploads
+func outboxInterval() time.Duration {
+	if viper.IsSet("worker.outbox.interval_seconds") {
+		return time.Duration(viper.GetInt64("worker.outbox.interval_seconds")) * time.Second
+	}
+	return defaultOutboxIntervalSeconds * time.Second
+}
+
+// recoverTasks fails the tasks that were still in progress when the worker stopped and
+// sends the updates that could not be delivered before.
+// Tasks that cannot be updated are kept in the journal and retried later.
+func recoverTasks(j *journal.Journal, makeTask func(ctx context.Context, url string) catalogtask.CatalogTask) {
+	entries, err := j.Entries()
+	if err != nil {
+		log.Errorf("Error reading the task journal %v", err)
+		return
+	}
+	for _, entry := range entries {
+		data := entry.PendingUpdate
+		if data != nil {
+			log.Infof("Sending the undelivered update of task %s", entry.URL)
+		} else {
+			log.Infof("Recovering task %s left in phase %s", entry.URL, entry.Phase)
+			data = map[string]interface{}{
+				"state":   "completed",
+				"status":  "error",
+				"message": fmt.Sprintf("Catalog Worker restarted while the task was %s, accepted at %s", entry.Phase, entry.AcceptedAt.Format(time.RFC3339)),
+			}
+		}
+		deliverUpdate(j, makeTask, entry.URL, data)
+	}
+}
+
+// startDispatcher runs the jobs of a request and signals the WaitChannel once all of them,
+// including the jobs dispatched by the workers, are finished, or once it stopped them. It only wakes up for events,
+// a job counts as outstanding from the moment it is accepted until its worker finishes.
+// Workers dispatch related jobs before they finish and the DispatchChannel is unbuffered,
+// so the count can't drop to zero while a worker still has jobs to hand over.
+// Once the ctx is done it waits for the running workers to abort, at most for the
+// shutdown grace period, the workers left behind drop their late results.
+func startDispatcher(ctx context.Context, config *common.CatalogConfig, jobs []common.JobParam, wc towerapiworker.WorkChannels, pw common.PageWriter, wh towerapiworker.WorkHandler, p *progress) {
 	glog := logger.GetLogger(ctx)
-	done := false
-	totalCount := 0
-	finishedCount := 0
-	for !done {
+	pool := makeWorkerPool()
+	defer pool.drain()
+	dispatcherDone := make(chan struct{})
+	defer close(dispatcherDone)
+	for _, job := range jobs {
+		glog.Infof("Job Input Data %v", job)
+		pool.add(job)
+		atomic.AddInt64(&p.jobsDispatched, 1)
+	}
+	startQueuedWorkers(ctx, config, pool, wh, wc, dispatcherDone)
+	stop := ctx.Done()
+	var grace <-chan time.Time
+	abandoned := false
+	for !pool.idle() && !abandoned {
 		select {
 		case job := <-wc.DispatchChannel:
+			if ctx.Err() != nil {
+				glog.Infof("Job dropped %s %v", job.HrefSlug, ctx.Err())
+				continue
+			}
 			glog.Infof("Job Input Data %v", job)
-			totalCount++
-			go startWorker(ctx, config, job, wh, wc)
-		case <-wc.Shutdown:
-			done = true
+			pool.add(job)
+			atomic.AddInt64(&p.jobsDispatched, 1)
+			startQueuedWorkers(ctx, config, pool, wh, wc, dispatcherDone)
+		case <-stop:
+			// Stop dispatching and wait for the running workers to abort
+			glog.Infof("Dispatcher stopping %v", ctx.Err())
+			pool.drain()
+			stop = nil
+			grace = time.After(shutdownGrace())
+		case <-grace:
+			glog.Errorf("Dispatcher stopped with %d workers still running, their results are dropped", pool.running)
+			abandoned = true
 		case page := <-wc.ResponseChannel:
 			glog.Infof("Data received on response channel %s", page.Name)
 			err := pw.Write(page.Name, page.Data)
 			if err != nil {
 				glog.Errorf("Error writing page %v", err)
 			}
+			atomic.AddInt64(&p.pages, 1)
+			atomic.AddInt64(&p.bytes, int64(len(page.Data)))
 		case <-wc.FinishedChannel:
-			finishedCount++
-		default:
-			if totalCount > 0 && totalCount == finishedCount {
-				done = true
-			}
+			pool.done()
+			atomic.AddInt64(&p.jobsFinished, 1)
+			startQueuedWorkers(ctx, config, pool, wh, wc, dispatcherDone)
 		}
 	}
-	wc.WaitChannel <- true
+	// The jobs only count as stopped if the dispatcher saw the ctx done before they all finished
+	wc.WaitChannel <- stop != nil
+}
+
+// shutdownGrace is how long the dispatcher waits for running workers after the request is cancelled
+func shutdownGrace() time.Duration {
+	if viper.IsSet("worker.shutdown_grace_ms") {
+		return time.Duration(viper.GetInt64("worker.shutdown_grace_ms")) * time.Millisecond
+	}
+	return 30 * time.Second
+}
+
+// startQueuedWorkers starts workers for queued jobs as long as the pool has room
+func startQueuedWorkers(ctx context.Context, config *common.CatalogConfig, pool *workerPool, wh towerapiworker.WorkHandler, wc towerapiworker.WorkChannels, dispatcherDone <-chan struct{}) {
+	for job, ok := pool.next(); ok; job, ok = pool.next() {
+		go startWorker(ctx, config, job, wh, wc, dispatcherDone)
+	}
+}
+
+// startRequest processes a task in the background unless the same task is already running
+// or was completed recently. It returns false, without processing, for a duplicate delivery.
+func startRequest(ctx context.Context, url string, config *common.CatalogConfig, wh towerapiworker.WorkHandler, shutdown chan struct{}) bool {
+	glog := logger.GetLogger(ctx)
+	if ok, state := registry.begin(url); !ok {
+		glog.Infof("Duplicate delivery of task %s ignored, the task is already %s", url, state)
+		return false
+	}
+	go func() {
+		completed := false
+		defer func() {
+			// A task that never got its final update is forgotten so a redelivery can run it
+			if completed {
+				registry.finish(url)
+			} else {
+				registry.forget(url)
+			}
+		}()
+		completed = processRequest(ctx, url, config, wh, catalogtask.MakeCatalogTask(ctx, url), &defaultPageWriterFactory{}, shutdown)
+	}()
+	return true
 }
 
 type pageWriterFactory interface {
@@ -107,6 +276,8 @@ func (factory *defaultPageWriterFactory) makePageWriter(ctx context.Context, inp
 	switch strings.ToLower(input.ResponseFormat) {
 	case "tar":
 		pw, err = tarwriter.MakeTarWriter(ctx, task, input, metadata)
+	case "tar-delta":
+		pw, err = tarwriter.MakeDeltaWriter(ctx, task, input, metadata)
 	case "json":
 		pw = jsonwriter.MakeJSONWriter(ctx, task)
 	default:
@@ -117,90 +288,203 @@ func (factory *defaultPageWriterFactory) makePageWriter(ctx context.Context, inp
 
 // Process the incoming Work Request
 // Fetch the Actual WorkPayload and start the work
+// Returns true once the final update of the task was delivered or kept in the journal,
+// or the tar file was queued in the outbox that sends it
 func processRequest(ctx context.Context,
 	url string, config *common.CatalogConfig,
 	wh towerapiworker.WorkHandler,
 	task catalogtask.CatalogTask,
 	pwFactory pageWriterFactory,
-	shutdown chan struct{}) {
+	shutdown chan struct{}) (completed bool) {
 
 	glog := logger.GetLogger(ctx)
 	defer glog.Info("Request finished")
+	journalPhase(glog, url, "accepted")
+	jt := makeJournaledTask(glog, url, task)
+	task = jt
+	defer func() {
+		completed = jt.hasFinal()
+	}()
+	defer func() {
+		if jt.hasUndelivered() {
+			return
+		}
+		if err := taskJournal.Remove(url); err != nil {
+			glog.Errorf("Error removing the task from the journal %v", err)
+		}
+	}()
 
 	req, err := task.Get()
 	if err != nil {
 		glog.Errorf("Error parsing payload in %s, reason %v", url, err)
 		return
 	}
-	metadata := map[string]string{"task_url": url}
+	metadata := map[string]string{"task_url": url, "worker_version": build.Version}
+	addTowerIdentity(ctx, req.Input.ResponseFormat, metadata)
 
-	pw, err := pwFactory.makePageWriter(ctx, req.Input, task, metadata)
+	// The page writer updates the task through the heartbeats so they stop when it is completed
+	ht := makeHeartbeatTask(glog, task)
+	defer ht.stopHeartbeats()
+	pw, err := pwFactory.makePageWriter(ctx, req.Input, ht, metadata)
 	if err != nil {
 		glog.Errorf("Error creating a page writer for type %s, reason %v", req.Input.ResponseFormat, err)
 		return
 	}
+	if cancelRequested(req) {
+		glog.Infof("Task was cancelled before it started")
+		if err := pw.Abort("cancelled", "Catalog Worker did not start, the task was cancelled", nil); err != nil {
+			glog.Errorf("Error updating the cancelled task %v", err)
+		}
+		return
+	}
+	policy, err := governance.Configured()
+	if err != nil {
+		glog.Errorf("Error loading the data policy %v", err)
+		if err := pw.Abort("error", "Catalog Worker did not start, the data policy could not be loaded", nil); err != nil {
+			glog.Errorf("Error updating the task %v", err)
+		}
+		return
+	}
+	enforcer := policy.Enforcer()
+	access, err := accesspolicy.Configured()
+	if err != nil {
+		glog.Errorf("Error loading the access policy %v", err)
+		if err := pw.Abort("error", "Catalog Worker did not start, the access policy could not be loaded", nil); err != nil {
+			glog.Errorf("Error updating the task %v", err)
+		}
+		return
+	}
 
 	err = task.Update(map[string]interface{}{"state": "running", "message": "Catalog Worker Started at " + time.Now().Format(time.RFC3339)})
 	if err != nil {
 		glog.Errorf("Error updating the task with the starting message, reason %v", err)
 		return
 	}
+	journalPhase(glog, url, "running")
+	ht.start()
+	if po, ok := pw.(common.PhaseObserver); ok {
+		po.ObservePhase(ht.progress.setPhase)
+	}
+
+	timeout := viper.GetFloat64("worker.timeout_minutes")
+	if timeout == 0 {
+		timeout = 10
+	}
+	ctx, cancelJobs := towerapiworker.WithJobCancellation(ctx)
+	ctx = governance.WithEnforcer(ctx, enforcer)
+	ctx = accesspolicy.WithPolicy(ctx, access)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout*float64(time.Minute)))
+	defer cancel()
+	cc := makeCloudCancel(glog, cancel, cancelJobs)
+	go func() {
+		select {
+		case <-shutdown:
+			glog.Infof("Shutdown received")
+			cancel()
+		case <-registry.cancelled(url):
+			cc.request("a cancel message was received")
+		case <-ctx.Done():
+		}
+	}()
+	go pollCancellation(ctx, glog, task, cancelPollInterval(), cc.request)
 
 	wc := towerapiworker.WorkChannels{}
-	wc.ErrorChannel = make(chan string)
+	wc.ErrorChannel = make(chan common.JobError)
+	wc.PartialErrorChannel = make(chan common.JobError)
 	wc.DispatchChannel = make(chan common.JobParam)
 	wc.ResponseChannel = make(chan common.Page)
 	wc.FinishedChannel = make(chan bool)
 	wc.WaitChannel = make(chan bool)
-	defer close(wc.ErrorChannel)
-	defer close(wc.DispatchChannel)
-	defer close(wc.FinishedChannel)
-	defer close(wc.ResponseChannel)
-	defer close(wc.WaitChannel)
+	// The channels are never closed, workers still running after a timeout or shutdown
+	// select on the cancelled ctx and drop their results instead of sending on a closed channel.
 
-	wc.Shutdown = shutdown
-	go startDispatcher(ctx, config, wc, pw, wh)
+	go startDispatcher(ctx, config, req.Input.Jobs, wc, pw, wh, ht.progress)
 
-	for _, j := range req.Input.Jobs {
-		wc.DispatchChannel <- j
-	}
-
-	timeout := viper.GetInt64("worker.timeout_minutes")
-	if timeout == 0 {
-		timeout = 10
-	}
-	var allErrors []string
+	var allErrors []common.JobError
+	var partialErrors []common.JobError
+	// stopped is the reason the jobs were stopped, nil if all of them finished. It is taken when
+	// the dispatcher is done, a timeout that fires later must not discard the finished jobs.
+	var stopped error
 	allDone := false
 	for !allDone {
 		select {
-		case <-wc.WaitChannel:
+		case finished := <-wc.WaitChannel:
 			glog.Info("Workers finished")
+			if !finished {
+				stopped = ctx.Err()
+			}
 			allDone = true
 		case data := <-wc.ErrorChannel:
-			glog.Errorf("Error received %s", data)
+			glog.Errorf("Error received %v", data)
 			allErrors = append(allErrors, data)
-		case <-time.After(time.Duration(timeout) * time.Minute):
-			glog.Infof("Waitgroup timed out")
-			allDone = true
-		case <-wc.Shutdown:
-			glog.Infof("Shutdown received")
-			allDone = true
+			atomic.AddInt64(&ht.progress.errors, 1)
+		case data := <-wc.PartialErrorChannel:
+			glog.Errorf("Error received from a job that continues on error %v", data)
+			partialErrors = append(partialErrors, data)
+			atomic.AddInt64(&ht.progress.errors, 1)
 		}
 	}
 
-	if len(allErrors) > 0 {
-		err := pw.FlushErrors(allErrors)
-		if err != nil {
-			glog.Errorf("Error flushing errors to server %v", err)
+	journalPhase(glog, url, "flushing")
+	ht.progress.setPhase("uploading")
+	switch stopped {
+	case context.DeadlineExceeded:
+		glog.Infof("Request timed out")
+		err = pw.Abort("timedout", fmt.Sprintf("Catalog Worker timed out after %s minutes", strconv.FormatFloat(timeout, 'f', -1, 64)), append(allErrors, partialErrors...))
+	case context.Canceled:
+		glog.Infof("Request cancelled")
+		message := "Catalog Worker was cancelled"
+		if cc.wasRequested() {
+			message = "Catalog Worker was cancelled on request"
+		}
+		err = pw.Abort("cancelled", message, append(allErrors, partialErrors...))
+	default:
+		if len(allErrors) == 0 {
+			if err := enforcer.WriteManifest(pw.Write); err != nil {
+				glog.Errorf("Error writing the data policy manifest %v", err)
+				allErrors = append(allErrors, common.JobError{Method: "policy", Message: "Failed to write the data policy manifest", Timestamp: time.Now().UTC()})
+			}
+		}
+		if len(allErrors) > 0 {
+			err = pw.FlushErrors(append(allErrors, partialErrors...))
+		} else if len(partialErrors) > 0 {
+			err = pw.FlushPartial(partialErrors)
+		} else {
+			err = pw.Flush()
 		}
-	} else {
-		pw.Flush()
+	}
+	if err != nil {
+		glog.Errorf("Error flushing to server %v", err)
+	}
+	return
+}
+
+func journalPhase(glog logger.Logger, url string, phase string) {
+	if err := taskJournal.Record(url, phase); err != nil {
+		glog.Errorf("Error recording the task phase %s in the journal %v", phase, err)
 	}
 }
 
 // Start a work
-func startWorker(ctx context.Context, config *common.CatalogConfig, job common.JobParam, wh towerapiworker.WorkHandler, wc towerapiworker.WorkChannels) {
+func startWorker(ctx context.Context, config *common.CatalogConfig, job common.JobParam, wh towerapiworker.WorkHandler, wc towerapiworker.WorkChannels, dispatcherDone <-chan struct{}) {
 	glog := logger.GetLogger(ctx)
+	defer func() {
+		select {
+		case wc.FinishedChannel <- true:
+		case <-dispatcherDone:
+			glog.Infof("Worker finished after the dispatcher stopped %v", ctx.Err())
+		}
+	}()
+	if !acquireGlobalSlot(ctx.Done()) {
+		glog.Info("Worker cancelled before starting")
+		return
+	}
+	defer releaseGlobalSlot()
+	if job.ContinueOnError {
+		wc.ErrorChannel = wc.PartialErrorChannel
+	}
+	defer recoverWorker(ctx, job, wc)
+
 	glog.Info("Worker starting")
 	glog.Info(stats())
 	defer glog.Info("Worker finished")
@@ -208,7 +492,27 @@ func startWorker(ctx context.Context, config *common.CatalogConfig, job common.J
 	if err != nil {
 		glog.Errorf("Error starting work  %v", err)
 	}
-	wc.FinishedChannel <- true
+}
+
+// recoverWorker turns a panic in a worker into an error of the task, the other workers keep running
+func recoverWorker(ctx context.Context, job common.JobParam, wc towerapiworker.WorkChannels) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	glog := logger.GetLogger(ctx)
+	glog.Errorf("Worker panicked %v\n%s", r, debug.Stack())
+	e := common.JobError{
+		Href:      job.HrefSlug,
+		Method:    strings.ToLower(job.Method),
+		Message:   fmt.Sprintf("Worker failed unexpectedly: %v", r),
+		Timestamp: time.Now().UTC(),
+	}
+	select {
+	case wc.ErrorChannel <- e:
+	case <-ctx.Done():
+		glog.Errorf("Error dropped %v", e)
+	}
 }
 
 // stats
@@ -216,11 +520,22 @@ func stats() string {
 	var ms runtime.MemStats
 	runtime.ReadMemStats(&ms)
 
-	return fmt.Sprintf("Current Stats Alloc = %v MiB TotalAlloc = %v MiB Sys = %v MiB NumGC = %v NumGoroutine = %v",
-		bToMb(ms.Alloc), bToMb(ms.TotalAlloc), bToMb(ms.Sys), ms.NumGC, runtime.NumGoroutine())
+	user, sys := cpuTime()
+	return fmt.Sprintf("Current Stats Alloc = %v MiB TotalAlloc = %v MiB Sys = %v MiB NumGC = %v NumGoroutine = %v RunningWorkers = %v QueuedJobs = %v CPUUser = %v CPUSys = %v",
+		bToMb(ms.Alloc), bToMb(ms.TotalAlloc), bToMb(ms.Sys), ms.NumGC, runtime.NumGoroutine(),
+		atomic.LoadInt64(&runningWorkers), atomic.LoadInt64(&queuedJobs), user, sys)
 
 }
 
 func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
 }
+
+// cpuTime returns the user and system CPU time used by the process
+func cpuTime() (time.Duration, time.Duration) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	return time.Duration(ru.Utime.Nano()), time.Duration(ru.Stime.Nano())
+}
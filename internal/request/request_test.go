@@ -3,16 +3,27 @@ package request
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/governance"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/journal"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
 )
 
@@ -25,7 +36,27 @@ func (fh *fakeHandler) StartWork(ctx context.Context, config *common.CatalogConf
 	return nil
 }
 
-type fakeCatalogTask struct{}
+type slowHandler struct {
+	running    int32
+	maxRunning int32
+}
+
+func (sh *slowHandler) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc towerapiworker.WorkChannels) error {
+	n := atomic.AddInt32(&sh.running, 1)
+	defer atomic.AddInt32(&sh.running, -1)
+	for {
+		max := atomic.LoadInt32(&sh.maxRunning)
+		if n <= max || atomic.CompareAndSwapInt32(&sh.maxRunning, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return nil
+}
+
+type fakeCatalogTask struct {
+	jobs []common.JobParam // overrides the default jobs
+}
 
 func (task *fakeCatalogTask) Get() (*common.CatalogInventoryTask, error) {
 	message := common.CatalogInventoryTask{
@@ -40,6 +71,9 @@ func (task *fakeCatalogTask) Get() (*common.CatalogInventoryTask, error) {
 			},
 		},
 	}
+	if task.jobs != nil {
+		message.Input.Jobs = task.jobs
+	}
 	return &message, nil
 }
 
@@ -53,16 +87,39 @@ func (task *fakeCatalogTask) Update(data map[string]interface{}) error {
 	return nil
 }
 
-type fakePageWriter struct{}
+type fakePageWriter struct {
+	pages         []string
+	abortStatus   string
+	abortMessage  string
+	errors        []common.JobError
+	partialErrors []common.JobError
+}
 
-func (pw *fakePageWriter) Write(name string, b []byte) error { return nil }
-func (pw *fakePageWriter) Flush() error                      { return nil }
-func (pw *fakePageWriter) FlushErrors(msg []string) error    { return nil }
+func (pw *fakePageWriter) Write(name string, b []byte) error {
+	pw.pages = append(pw.pages, name)
+	return nil
+}
+func (pw *fakePageWriter) Flush() error { return nil }
+func (pw *fakePageWriter) FlushErrors(errors []common.JobError) error {
+	pw.errors = errors
+	return nil
+}
+func (pw *fakePageWriter) FlushPartial(errors []common.JobError) error {
+	pw.partialErrors = errors
+	return nil
+}
+func (pw *fakePageWriter) Abort(status string, message string, errors []common.JobError) error {
+	pw.abortStatus = status
+	pw.abortMessage = message
+	return nil
+}
 
-type fakePageWriterFactory struct{}
+type fakePageWriterFactory struct {
+	pw fakePageWriter
+}
 
 func (factory *fakePageWriterFactory) makePageWriter(ctx context.Context, input common.RequestInput, task catalogtask.CatalogTask, metadata map[string]string) (common.PageWriter, error) {
-	return &fakePageWriter{}, nil
+	return &factory.pw, nil
 }
 
 func TestProcessRequest(t *testing.T) {
@@ -76,6 +133,339 @@ func TestProcessRequest(t *testing.T) {
 	}
 }
 
+func TestProcessRequestConcurrency(t *testing.T) {
+	viper.Set("worker.max_concurrency", 1)
+	defer viper.Set("worker.max_concurrency", 0)
+	sh := slowHandler{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &sh, &fakeCatalogTask{}, &fakePageWriterFactory{}, make(chan struct{}))
+	assert.Equal(t, int32(1), sh.maxRunning, "Workers running at the same time")
+}
+
+func TestProcessRequestDataPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "policy.json")
+	assert.NoError(t, ioutil.WriteFile(policy, []byte(`{"types": {"job_template": ["*"]}}`), 0600))
+	viper.Set("worker.data_policy_file", policy)
+	defer viper.Set("worker.data_policy_file", nil)
+
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &fakeHandler{}, &fakeCatalogTask{}, &pwf, make(chan struct{}))
+	assert.Equal(t, []string{governance.ManifestName}, pwf.pw.pages)
+
+	viper.Set("worker.data_policy_file", filepath.Join(dir, "missing.json"))
+	fh := fakeHandler{}
+	pwf = fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &fh, &fakeCatalogTask{}, &pwf, make(chan struct{}))
+	assert.Equal(t, "error", pwf.pw.abortStatus)
+	assert.Equal(t, "Catalog Worker did not start, the data policy could not be loaded", pwf.pw.abortMessage)
+	assert.Equal(t, uint32(0), fh.timesCalled, "Nothing is collected without the policy")
+}
+
+func TestProcessRequestAccessPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesspolicy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "policy.json")
+	assert.NoError(t, ioutil.WriteFile(policy, []byte(`{"rules": [`), 0600))
+	viper.Set("worker.access_policy_file", policy)
+	defer viper.Set("worker.access_policy_file", nil)
+
+	fh := fakeHandler{}
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &fh, &fakeCatalogTask{}, &pwf, make(chan struct{}))
+	assert.Equal(t, "error", pwf.pw.abortStatus)
+	assert.Equal(t, "Catalog Worker did not start, the access policy could not be loaded", pwf.pw.abortMessage)
+	assert.Equal(t, uint32(0), fh.timesCalled, "No job runs without the policy")
+}
+
+type blockingHandler struct{}
+
+func (bh *blockingHandler) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc towerapiworker.WorkChannels) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestProcessRequestShutdown(t *testing.T) {
+	pwf := fakePageWriterFactory{}
+	shutdown := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(shutdown)
+	}()
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &blockingHandler{}, &fakeCatalogTask{}, &pwf, shutdown)
+	assert.Equal(t, "cancelled", pwf.pw.abortStatus)
+}
+
+func TestProcessRequestTimeout(t *testing.T) {
+	viper.Set("worker.timeout_minutes", 0.002)
+	defer viper.Set("worker.timeout_minutes", nil)
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &blockingHandler{}, &fakeCatalogTask{}, &pwf, make(chan struct{}))
+	assert.Equal(t, "timedout", pwf.pw.abortStatus)
+	assert.Equal(t, "Catalog Worker timed out after 0.002 minutes", pwf.pw.abortMessage)
+}
+
+func TestDispatcherFinishedBeforeCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.CtxWithLoggerID(context.Background(), "123"))
+	defer cancel()
+	wc := towerapiworker.WorkChannels{
+		ErrorChannel:        make(chan common.JobError),
+		PartialErrorChannel: make(chan common.JobError),
+		DispatchChannel:     make(chan common.JobParam),
+		ResponseChannel:     make(chan common.Page),
+		FinishedChannel:     make(chan bool),
+		WaitChannel:         make(chan bool),
+	}
+	p := &progress{phase: "collecting"}
+	jobs := []common.JobParam{{Method: "get", HrefSlug: "/api/v2/inventories/899"}}
+	go startDispatcher(ctx, &common.CatalogConfig{}, jobs, wc, &fakePageWriter{}, &fakeHandler{}, p)
+
+	for atomic.LoadInt64(&p.jobsFinished) < int64(len(jobs)) {
+		time.Sleep(time.Millisecond)
+	}
+	// The ctx ends after the jobs finished but before the request reads the outcome
+	cancel()
+	assert.True(t, <-wc.WaitChannel, "The finished jobs are not reported as stopped")
+}
+
+// relatedHandler dispatches a related job for every job up to depth related jobs
+type relatedHandler struct {
+	depth       int
+	timesCalled uint32
+}
+
+func (rh *relatedHandler) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc towerapiworker.WorkChannels) error {
+	atomic.AddUint32(&rh.timesCalled, 1)
+	level := strings.Count(params.HrefSlug, "/related")
+	if level < rh.depth {
+		// Let the other workers finish first so a premature end of the request would show up
+		time.Sleep(10 * time.Millisecond)
+		wc.DispatchChannel <- common.JobParam{Method: "GET", HrefSlug: params.HrefSlug + "/related"}
+	}
+	return nil
+}
+
+func TestProcessRequestRelatedJobs(t *testing.T) {
+	rh := relatedHandler{depth: 3}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &rh, &fakeCatalogTask{}, &fakePageWriterFactory{}, make(chan struct{}))
+	assert.Equal(t, uint32(8), atomic.LoadUint32(&rh.timesCalled), "2 jobs with 3 levels of related jobs each")
+}
+
+func TestDispatcherIdleCPU(t *testing.T) {
+	pwf := fakePageWriterFactory{}
+	shutdown := make(chan struct{})
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		close(shutdown)
+	}()
+	user, sys := cpuTime()
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &blockingHandler{}, &fakeCatalogTask{}, &pwf, shutdown)
+	afterUser, afterSys := cpuTime()
+	assert.Less(t, int64(afterUser-user+afterSys-sys), int64(100*time.Millisecond), "CPU used while waiting for the workers")
+}
+
+func TestStatsCPU(t *testing.T) {
+	assert.Contains(t, stats(), "CPUUser = ")
+}
+
+// stubbornHandler ignores the cancellation and reports its results late
+type stubbornHandler struct {
+	delay   time.Duration
+	started chan struct{}
+	done    chan struct{}
+}
+
+func (sh *stubbornHandler) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc towerapiworker.WorkChannels) error {
+	defer func() { sh.done <- struct{}{} }()
+	sh.started <- struct{}{}
+	time.Sleep(sh.delay)
+	select {
+	case wc.ResponseChannel <- common.Page{Name: "late", Data: []byte("{}")}:
+	case <-ctx.Done():
+	}
+	select {
+	case wc.ErrorChannel <- common.JobError{Href: params.HrefSlug, Message: "late error"}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func TestProcessRequestLateWorkers(t *testing.T) {
+	viper.Set("worker.shutdown_grace_ms", 20)
+	defer viper.Set("worker.shutdown_grace_ms", nil)
+	sh := stubbornHandler{delay: 200 * time.Millisecond, started: make(chan struct{}, 2), done: make(chan struct{}, 2)}
+	pwf := fakePageWriterFactory{}
+	shutdown := make(chan struct{})
+	go func() {
+		<-sh.started
+		<-sh.started
+		close(shutdown)
+	}()
+
+	start := time.Now()
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &sh, &fakeCatalogTask{}, &pwf, shutdown)
+	assert.True(t, time.Since(start) < sh.delay, "Request should not wait for the workers past the grace period")
+	assert.Equal(t, "cancelled", pwf.pw.abortStatus)
+
+	// The late workers must finish without a panic and without leaking
+	<-sh.done
+	<-sh.done
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&runningWorkers) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestProcessRequestSlowTower(t *testing.T) {
+	before := runtime.NumGoroutine()
+	requests := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": 1}`)
+	}))
+
+	pwf := fakePageWriterFactory{}
+	shutdown := make(chan struct{})
+	go func() {
+		<-requests
+		close(shutdown)
+	}()
+	config := common.CatalogConfig{URL: ts.URL, Retry: retry.Policy{MaxAttempts: 1}}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &config, &towerapiworker.DefaultAPIWorker{}, &fakeCatalogTask{}, &pwf, shutdown)
+	assert.Equal(t, "cancelled", pwf.pw.abortStatus)
+
+	ts.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	for deadline := time.Now().Add(2 * time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "Goroutines leaked")
+}
+
+// panicHandler panics for the inventory job
+type panicHandler struct {
+	timesCalled uint32
+}
+
+func (ph *panicHandler) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc towerapiworker.WorkChannels) error {
+	atomic.AddUint32(&ph.timesCalled, 1)
+	if strings.Contains(params.HrefSlug, "inventories") {
+		var obj interface{} = "not an object"
+		_ = obj.(map[string]interface{})
+	}
+	return nil
+}
+
+func TestProcessRequestWorkerPanic(t *testing.T) {
+	ph := panicHandler{}
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &ph, &fakeCatalogTask{}, &pwf, make(chan struct{}))
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&ph.timesCalled), "The other jobs should keep running")
+	assert.Len(t, pwf.pw.errors, 1)
+	assert.Equal(t, "/api/v2/inventories/899", pwf.pw.errors[0].Href)
+	assert.Equal(t, "get", pwf.pw.errors[0].Method)
+	assert.Contains(t, pwf.pw.errors[0].Message, "Worker failed unexpectedly: interface conversion")
+	assert.Equal(t, int64(0), atomic.LoadInt64(&runningWorkers))
+}
+
+// failingHandler reports an error for the jobs of the survey specs
+type failingHandler struct{}
+
+func (fh *failingHandler) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc towerapiworker.WorkChannels) error {
+	if strings.HasSuffix(params.HrefSlug, "survey_spec") {
+		wc.ErrorChannel <- common.JobError{Href: params.HrefSlug, HTTPStatus: 404, Message: "Not Found"}
+	}
+	return nil
+}
+
+func TestProcessRequestPartial(t *testing.T) {
+	ct := fakeCatalogTask{jobs: []common.JobParam{
+		{Method: "get", HrefSlug: "/api/v2/job_templates"},
+		{Method: "get", HrefSlug: "/api/v2/job_templates/5/survey_spec", ContinueOnError: true},
+	}}
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &failingHandler{}, &ct, &pwf, make(chan struct{}))
+	assert.Nil(t, pwf.pw.errors)
+	assert.Equal(t, []common.JobError{{Href: "/api/v2/job_templates/5/survey_spec", HTTPStatus: 404, Message: "Not Found"}}, pwf.pw.partialErrors)
+}
+
+func TestProcessRequestRequiredJobFailed(t *testing.T) {
+	ct := fakeCatalogTask{jobs: []common.JobParam{
+		{Method: "get", HrefSlug: "/api/v2/job_templates/5/survey_spec"},
+		{Method: "get", HrefSlug: "/api/v2/job_templates/6/survey_spec", ContinueOnError: true},
+	}}
+	pwf := fakePageWriterFactory{}
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &failingHandler{}, &ct, &pwf, make(chan struct{}))
+	assert.Nil(t, pwf.pw.partialErrors)
+	assert.Equal(t, []common.JobError{
+		{Href: "/api/v2/job_templates/5/survey_spec", HTTPStatus: 404, Message: "Not Found"},
+		{Href: "/api/v2/job_templates/6/survey_spec", HTTPStatus: 404, Message: "Not Found"},
+	}, pwf.pw.errors)
+}
+
+type recordingTask struct {
+	url     string
+	updates *[]map[string]interface{}
+	fail    bool
+}
+
+func (task *recordingTask) Get() (*common.CatalogInventoryTask, error) { return nil, nil }
+
+func (task *recordingTask) Update(data map[string]interface{}) error {
+	if task.fail {
+		return fmt.Errorf("Task %s unreachable", task.url)
+	}
+	data["url"] = task.url
+	*task.updates = append(*task.updates, data)
+	return nil
+}
+
+func TestRecoverTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	j, err := journal.Open(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, j.Record("https://example.com/tasks/1", "running"))
+	assert.NoError(t, j.Record("https://example.com/tasks/2", "accepted"))
+
+	var updates []map[string]interface{}
+	recoverTasks(j, func(ctx context.Context, url string) catalogtask.CatalogTask {
+		return &recordingTask{url: url, updates: &updates, fail: url == "https://example.com/tasks/2"}
+	})
+
+	if assert.Equal(t, 1, len(updates)) {
+		assert.Equal(t, "https://example.com/tasks/1", updates[0]["url"])
+		assert.Equal(t, "completed", updates[0]["state"])
+		assert.Equal(t, "error", updates[0]["status"])
+		assert.Contains(t, updates[0]["message"], "Catalog Worker restarted while the task was running")
+	}
+	// the task that could not be updated is retried on the next start
+	entries, err := j.Entries()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, "https://example.com/tasks/2", entries[0].URL)
+	}
+}
+
+func TestProcessRequestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	taskJournal, err = journal.Open(dir)
+	assert.NoError(t, err)
+	defer func() { taskJournal = nil }()
+
+	processRequest(logger.CtxWithLoggerID(context.Background(), "123"), "testurl", &common.CatalogConfig{}, &fakeHandler{}, &fakeCatalogTask{}, &fakePageWriterFactory{}, make(chan struct{}))
+	entries, err := taskJournal.Entries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "Finished task should be removed from the journal")
+}
+
 func TestMakePageWriter(t *testing.T) {
 	ctx := logger.CtxWithLoggerID(context.Background(), "123")
 	factory := defaultPageWriterFactory{}
@@ -85,6 +475,10 @@ func TestMakePageWriter(t *testing.T) {
 	pwType := fmt.Sprintf("%v", reflect.TypeOf(pw))
 	assert.Equal(t, "*tarwriter.tarWriter", pwType, "Page Writer Type")
 
+	pw, _ = factory.makePageWriter(ctx, common.RequestInput{ResponseFormat: "tar-delta"}, catalogtask.MakeCatalogTask(ctx, "testurl"), metadata)
+	pwType = fmt.Sprintf("%v", reflect.TypeOf(pw))
+	assert.Equal(t, "*tarwriter.deltaWriter", pwType, "Page Writer Type")
+
 	pw, _ = factory.makePageWriter(ctx, common.RequestInput{ResponseFormat: "json"}, catalogtask.MakeCatalogTask(ctx, "testurl"), metadata)
 	pwType = fmt.Sprintf("%v", reflect.TypeOf(pw))
 	assert.Equal(t, "*jsonwriter.jsonWriter", pwType, "Page Writer Type")
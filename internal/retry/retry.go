@@ -0,0 +1,129 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultBaseBackoff = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+	defaultJitter      = 0.2
+)
+
+// Policy describes how often and how long to wait between attempts of a failed call
+type Policy struct {
+	MaxAttempts        int           // Total number of attempts including the first one
+	BaseBackoff        time.Duration // Wait before the second attempt, doubled for every subsequent attempt
+	MaxBackoff         time.Duration // Upper bound for a single wait, including waits requested by Retry-After
+	Jitter             float64       // Fraction of the wait that is randomized, between 0 and 1
+	RetryNonIdempotent bool          // Also retry methods like POST that are not idempotent
+}
+
+// MakePolicy reads a retry policy from the config section e.g. worker.retry.
+// Attributes missing from the section use the defaults.
+func MakePolicy(section string) Policy {
+	p := Policy{
+		MaxAttempts: defaultMaxAttempts,
+		BaseBackoff: defaultBaseBackoff,
+		MaxBackoff:  defaultMaxBackoff,
+		Jitter:      defaultJitter,
+	}
+	if viper.IsSet(section + ".max_attempts") {
+		p.MaxAttempts = viper.GetInt(section + ".max_attempts")
+	}
+	if viper.IsSet(section + ".base_backoff_ms") {
+		p.BaseBackoff = time.Duration(viper.GetInt64(section+".base_backoff_ms")) * time.Millisecond
+	}
+	if viper.IsSet(section + ".max_backoff_ms") {
+		p.MaxBackoff = time.Duration(viper.GetInt64(section+".max_backoff_ms")) * time.Millisecond
+	}
+	if viper.IsSet(section + ".jitter") {
+		p.Jitter = viper.GetFloat64(section + ".jitter")
+	}
+	p.RetryNonIdempotent = viper.GetBool(section + ".retry_non_idempotent")
+	return p
+}
+
+// Attempts returns the number of attempts allowed for an HTTP method
+func (p Policy) Attempts(method string) int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	if !p.RetryNonIdempotent && !idempotent(method) {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// Backoff returns the wait after the given failed attempt, starting at 1.
+// A Retry-After header in the response takes precedence over the exponential backoff.
+func (p Policy) Backoff(attempt int, header http.Header) time.Duration {
+	if d, ok := RetryAfter(header, time.Now()); ok {
+		return p.limit(d)
+	}
+	d := float64(p.BaseBackoff) * math.Pow(2, float64(attempt-1))
+	if p.Jitter > 0 {
+		j := math.Min(p.Jitter, 1)
+		d = d*(1-j) + d*j*rand.Float64()
+	}
+	return p.limit(time.Duration(d))
+}
+
+func (p Policy) limit(d time.Duration) time.Duration {
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// RetryableStatus reports if an HTTP status code indicates a transient failure
+func RetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RetryAfter parses the Retry-After header which can either be
+// delay in seconds or an HTTP date
+func RetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if header == nil {
+		return 0, false
+	}
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+func idempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
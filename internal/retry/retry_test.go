@@ -0,0 +1,85 @@
+package retry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakePolicy(t *testing.T) {
+	p := MakePolicy("test_missing.retry")
+	assert.Equal(t, defaultMaxAttempts, p.MaxAttempts)
+	assert.Equal(t, defaultBaseBackoff, p.BaseBackoff)
+	assert.Equal(t, defaultMaxBackoff, p.MaxBackoff)
+	assert.Equal(t, defaultJitter, p.Jitter)
+	assert.False(t, p.RetryNonIdempotent)
+
+	viper.Set("test.retry.max_attempts", 5)
+	viper.Set("test.retry.base_backoff_ms", 100)
+	viper.Set("test.retry.max_backoff_ms", 2000)
+	viper.Set("test.retry.jitter", 0.5)
+	viper.Set("test.retry.retry_non_idempotent", true)
+	p = MakePolicy("test.retry")
+	assert.Equal(t, 5, p.MaxAttempts)
+	assert.Equal(t, 100*time.Millisecond, p.BaseBackoff)
+	assert.Equal(t, 2*time.Second, p.MaxBackoff)
+	assert.Equal(t, 0.5, p.Jitter)
+	assert.True(t, p.RetryNonIdempotent)
+}
+
+func TestAttempts(t *testing.T) {
+	p := Policy{MaxAttempts: 4}
+	assert.Equal(t, 4, p.Attempts("GET"))
+	assert.Equal(t, 1, p.Attempts("POST"))
+	p.RetryNonIdempotent = true
+	assert.Equal(t, 4, p.Attempts("POST"))
+	assert.Equal(t, 1, Policy{}.Attempts("GET"))
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, p.Backoff(1, nil))
+	assert.Equal(t, 2*time.Second, p.Backoff(2, nil))
+	assert.Equal(t, 4*time.Second, p.Backoff(3, nil))
+	assert.Equal(t, 5*time.Second, p.Backoff(4, nil))
+
+	p.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		d := p.Backoff(2, nil)
+		assert.True(t, d >= time.Second && d <= 2*time.Second, "Backoff %v out of range", d)
+	}
+}
+
+func TestBackoffRetryAfter(t *testing.T) {
+	p := Policy{BaseBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, 3*time.Second, p.Backoff(1, http.Header{"Retry-After": {"3"}}))
+	assert.Equal(t, 5*time.Second, p.Backoff(1, http.Header{"Retry-After": {"120"}}))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 2, 3, 10, 0, 0, 0, time.UTC)
+	d, ok := RetryAfter(http.Header{"Retry-After": {"7"}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, 7*time.Second, d)
+
+	d, ok = RetryAfter(http.Header{"Retry-After": {"Wed, 03 Feb 2021 10:00:30 GMT"}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = RetryAfter(http.Header{"Retry-After": {"soon"}}, now)
+	assert.False(t, ok)
+	_, ok = RetryAfter(http.Header{}, now)
+	assert.False(t, ok)
+}
+
+func TestRetryableStatus(t *testing.T) {
+	for _, code := range []int{408, 429, 500, 502, 503, 504} {
+		assert.True(t, RetryableStatus(code), "Status %d", code)
+	}
+	for _, code := range []int{200, 400, 401, 403, 404} {
+		assert.False(t, RetryableStatus(code), "Status %d", code)
+	}
+}
@@ -0,0 +1,110 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// ContentType of a signature sent with an upload
+const ContentType = "application/jose"
+
+// Payload is signed for every archive, it binds the digest of the archive to its task
+type Payload struct {
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	TaskURL string `json:"task_url"`
+}
+
+type header struct {
+	Alg string   `json:"alg"`
+	Typ string   `json:"typ"`
+	X5c []string `json:"x5c"` // The certificate chain of the signing key, DER in standard base64
+}
+
+// Enabled reports if the uploaded archives are signed
+func Enabled() bool {
+	return viper.GetBool("worker.upload.sign")
+}
+
+// Sign returns a JWS in compact serialization over the payload, signed with the key of the
+// consumer certificate configured in AUTH.client_cert and AUTH.client_key. The certificate
+// chain is added to the header so the receiver can verify it against the consumer identity.
+func Sign(p Payload) (string, error) {
+	certFile := viper.GetString("AUTH.client_cert")
+	keyFile := viper.GetString("AUTH.client_key")
+	if certFile == "" || keyFile == "" {
+		return "", errors.New("Signing needs AUTH.client_cert and AUTH.client_key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+	return SignWith(p, cert)
+}
+
+// SignWith returns a JWS in compact serialization over the payload signed with cert
+func SignWith(p Payload, cert tls.Certificate) (string, error) {
+	h := header{Typ: "JOSE"}
+	switch cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		h.Alg = "RS256"
+	case *ecdsa.PrivateKey:
+		h.Alg = "ES256"
+	default:
+		return "", fmt.Errorf("Unsupported key type %T", cert.PrivateKey)
+	}
+	for _, der := range cert.Certificate {
+		h.X5c = append(h.X5c, base64.StdEncoding.EncodeToString(der))
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	pb, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	input := encode(hb) + "." + encode(pb)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch key := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		sig, err = signES256(key, digest[:])
+	}
+	if err != nil {
+		return "", err
+	}
+	return input + "." + encode(sig), nil
+}
+
+// signES256 returns the fixed size r || s signature used by JWS
+func signES256(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	if key.Curve.Params().BitSize != 256 {
+		return nil, errors.New("ES256 needs a P-256 key")
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
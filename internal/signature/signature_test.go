@@ -0,0 +1,160 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTestCertificate writes a self signed consumer certificate for key and configures it in AUTH
+func useTestCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "consumer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "signature")
+	assert.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	viper.Set("AUTH.client_cert", certFile)
+	viper.Set("AUTH.client_key", keyFile)
+	t.Cleanup(func() {
+		viper.Set("AUTH.client_cert", nil)
+		viper.Set("AUTH.client_key", nil)
+		os.RemoveAll(dir)
+	})
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+// verify checks a JWS produced by Sign against the certificate in its header and returns
+// the certificate with the signed payload, like the receiver of an upload does
+func verify(jws string) (Payload, *x509.Certificate, error) {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return Payload{}, nil, errors.New("Signature is not a JWS in compact serialization")
+	}
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return Payload{}, nil, err
+	}
+	if len(h.X5c) == 0 {
+		return Payload{}, nil, errors.New("Signature has no certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(h.X5c[0])
+	if err != nil {
+		return Payload{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return Payload{}, nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Payload{}, nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if h.Alg != "RS256" {
+			return Payload{}, nil, fmt.Errorf("Algorithm %s does not match the RSA certificate", h.Alg)
+		}
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		if h.Alg != "ES256" || len(sig) != 64 {
+			return Payload{}, nil, fmt.Errorf("Algorithm %s does not match the ECDSA certificate", h.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			err = errors.New("ECDSA verification failure")
+		}
+	default:
+		err = fmt.Errorf("Unsupported key type %T", cert.PublicKey)
+	}
+	if err != nil {
+		return Payload{}, nil, err
+	}
+	var p Payload
+	if err := decodeJSON(parts[1], &p); err != nil {
+		return Payload{}, nil, err
+	}
+	return p, cert, nil
+}
+
+func TestSignAndVerify(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	p := Payload{SHA256: "37c1c1aa863d2c8144bf9ceeffaad5725faaeb171909da83701eda8ee1dc790e", Size: 263, TaskURL: "https://www.example.com/12345678"}
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		expected := useTestCertificate(t, key)
+		jws, err := Sign(p)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		signed, cert, err := verify(jws)
+		assert.NoError(t, err)
+		assert.Equal(t, p, signed)
+		assert.Equal(t, expected.Raw, cert.Raw)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	useTestCertificate(t, key)
+	jws, err := Sign(Payload{SHA256: "abc", Size: 3})
+	assert.NoError(t, err)
+
+	parts := strings.Split(jws, ".")
+	forged := parts[0] + "." + encode([]byte(`{"sha256":"def","size":3,"task_url":""}`)) + "." + parts[2]
+	_, _, err = verify(forged)
+	assert.Error(t, err)
+	_, _, err = verify("not a jws")
+	assert.Error(t, err)
+}
+
+func TestSignWithoutCertificate(t *testing.T) {
+	_, err := Sign(Payload{SHA256: "abc"})
+	assert.Error(t, err)
+}
+
+// decodeJSON decodes a base64url encoded part of a JWS
+func decodeJSON(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -3,104 +3,135 @@ package tarfiles
 import (
 	"archive/tar"
 	"compress/gzip"
-	"crypto/sha256"
-	"fmt"
 	"io"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// TarCompressDirectory compresses the whole directory into an output tar file and returns the sha256 of the tarfile
-func TarCompressDirectory(dir string, outfile string) (string, error) {
-	f, err := os.Create(outfile)
-	if err != nil {
-		log.Errorf("Error creating file %s", outfile)
-		return "", err
-	}
-
-	zw := gzip.NewWriter(f)
-	tw := tar.NewWriter(zw)
+// The modes the pages always had in the archive, the root is the temp directory
+// the pages were written to and the others were created with the default umask
+const rootDirMode = 0700
+const dirMode = 0755
+const fileMode = 0644
 
-	fn := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Errorf("Failure accessing a path %q: %v", path, err)
-			return err
-		}
+// blockSize is the size of a tar block, the archive ends with two zero blocks
+const blockSize = 512
 
-		hdr, err := tar.FileInfoHeader(info, path)
-		if err != nil {
-			log.Errorf("Error creating file info header")
-			return err
-		}
-		hdr.AccessTime = time.Unix(0, 0)
-		hdr.ChangeTime = time.Unix(0, 0)
-		hdr.ModTime = time.Unix(0, 0)
-		hdr.Name = filepath.ToSlash(path)
-		hdr.Name = strings.TrimPrefix(hdr.Name, dir)
-		hdr.Uid = 0
-		hdr.Uname = "unknown"
-		hdr.Gid = 0
-		hdr.Gname = "unknown"
-		if hdr.Name == "" {
-			hdr.Name = "./"
-		}
+// The archive is a gzip compressed tar file with every entry in a gzip member of its
+// own, gzip readers read the members of a file one after the other as a single stream.
+// An entry can therefore be compressed as soon as it is known and put in order later:
+// the members concatenated in the order of SortNames and followed by the end member
+// form the archive. The entry headers only depend on the entry names and sizes so
+// the same entries always produce the same bytes.
 
-		if err := tw.WriteHeader(hdr); err != nil {
-			log.Errorf("Error writing header")
-			return err
-		}
+// CompressDir writes a directory entry as a gzip member to w, name is relative to the archive root
+func CompressDir(w io.Writer, name string) error {
+	hdr := header(name)
+	hdr.Typeflag = tar.TypeDir
+	hdr.Mode = dirMode
+	if hdr.Name == "./" {
+		hdr.Mode = rootDirMode
+	}
+	return compress(w, hdr, nil)
+}
 
-		if !info.IsDir() {
-			source, err := os.Open(path)
-			if err != nil {
-				log.Errorf("Error opening file %q", path)
-				return err
-			}
-			defer source.Close()
+// CompressFile writes a file entry with size bytes read from r as a gzip member to w,
+// name is relative to the archive root
+func CompressFile(w io.Writer, name string, r io.Reader, size int64) error {
+	hdr := header(name)
+	hdr.Typeflag = tar.TypeReg
+	hdr.Mode = fileMode
+	hdr.Size = size
+	return compress(w, hdr, r)
+}
 
-			_, err = io.Copy(tw, source)
-			if err != nil {
-				log.Errorf("Error copying file bytes")
-				return err
-			}
-		}
-		return nil
+// CompressEnd writes the end of the archive as a gzip member to w
+func CompressEnd(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(make([]byte, 2*blockSize)); err != nil {
+		log.Errorf("Error writing the end of the tar file")
+		return err
 	}
-
-	err = filepath.Walk(dir, fn)
-	if err != nil {
-		log.Errorf("error walking directory %v", err)
-		return "", err
+	if err := zw.Close(); err != nil {
+		log.Errorf("Error closing compressed entry")
+		return err
 	}
+	return nil
+}
 
-	if err := tw.Close(); err != nil {
-		log.Errorf("Error closing tar file")
-		return "", err
+// compress writes the header, the data and the padding of an entry as a gzip member
+func compress(w io.Writer, hdr *tar.Header, r io.Reader) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(hdr); err != nil {
+		log.Errorf("Error writing header")
+		return err
+	}
+	if hdr.Size > 0 {
+		if _, err := io.CopyN(tw, r, hdr.Size); err != nil {
+			log.Errorf("Error copying file bytes")
+			return err
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		log.Errorf("Error padding file bytes")
+		return err
 	}
 	if err := zw.Close(); err != nil {
-		log.Errorf("Error closing compressed file")
-		return "", err
+		log.Errorf("Error closing compressed entry")
+		return err
 	}
+	return nil
+}
 
-	if _, err := f.Seek(0, 0); err != nil {
-		log.Errorf("Error seeking to top of file")
-		return "", err
+// Parents returns the parent directories of name that are not in dirs yet, outermost
+// first, and adds them to dirs. Their entries go before the entry of name.
+func Parents(name string, dirs map[string]bool) []string {
+	var parents []string
+	for dir := filepath.Dir("/" + strings.Trim(filepath.ToSlash(name), "/")); dir != "/" && !dirs[dir]; dir = filepath.Dir(dir) {
+		dirs[dir] = true
+		parents = append([]string{dir}, parents...)
 	}
+	return parents
+}
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, f); err != nil {
-		return "", err
+// header creates the header for an entry, the archive root is named ./
+// and all other entries have a leading /. The format is left to the tar
+// writer, it picks USTAR unless a name or a size needs PAX or GNU.
+func header(name string) *tar.Header {
+	name = strings.Trim(filepath.ToSlash(name), "/")
+	if name == "" || name == "." {
+		name = "./"
+	} else {
+		name = "/" + name
 	}
-	sum := hash.Sum(nil)
-
-	if err := f.Close(); err != nil {
-		log.Errorf("Error closing file")
-		return "", err
+	return &tar.Header{
+		Name:    name,
+		ModTime: time.Unix(0, 0),
+		Uname:   "unknown",
+		Gname:   "unknown",
 	}
+}
 
-	return fmt.Sprintf("%x", sum), nil
+// SortNames sorts entry names in the order a directory walk visits them,
+// each directory is immediately followed by its own entries
+func SortNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		return lessPath(names[i], names[j])
+	})
+}
+
+func lessPath(a, b string) bool {
+	pa := strings.Split(strings.Trim(filepath.ToSlash(a), "/"), "/")
+	pb := strings.Split(strings.Trim(filepath.ToSlash(b), "/"), "/")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] != pb[i] {
+			return pa[i] < pb[i]
+		}
+	}
+	return len(pa) < len(pb)
 }
@@ -1,33 +1,90 @@
 package tarfiles
 
 import (
-	"os"
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestTarCompressDirectory(t *testing.T) {
-	dirName, tarName := "testtarfiles", "testtarfiles.tar.gz"
-	defer os.RemoveAll(dirName)
-	defer os.Remove(tarName)
+func TestSortNames(t *testing.T) {
+	names := []string{"b/page.json", "a.json", "a/c/d.json", "a/b.json"}
+	SortNames(names)
+	assert.Equal(t, []string{"a/b.json", "a/c/d.json", "a.json", "b/page.json"}, names)
+}
 
-	assert.NoError(t, os.Mkdir(dirName, 0755))
+func TestParents(t *testing.T) {
+	dirs := make(map[string]bool)
+	assert.Equal(t, []string{"/a", "/a/b"}, Parents("a/b/c.json", dirs))
+	assert.Equal(t, []string{"/a/d"}, Parents("/a/d/e.json", dirs))
+	assert.Empty(t, Parents("/a/b/f.json", dirs))
+	assert.Empty(t, Parents("g.json", dirs))
+}
 
-	for _, fname := range []string{"file1", "file2"} {
-		data := []byte(strings.Repeat("na", 512))
-		f, err := os.Create(dirName + "/" + fname)
-		assert.NoError(t, err)
-		_, err = f.Write(data)
-		assert.NoError(t, err)
-		f.Close()
+func TestCompressedMembers(t *testing.T) {
+	files := map[string]string{
+		"b/page.json": "b",
+		"a.json":      strings.Repeat("a", 600),
+		"a/c/d.json":  "acd",
+	}
+	// The entries are compressed in any order and joined in sorted order
+	members := make(map[string][]byte)
+	for name, data := range files {
+		var buf bytes.Buffer
+		assert.NoError(t, CompressFile(&buf, name, strings.NewReader(data), int64(len(data))))
+		members[name] = buf.Bytes()
 	}
+	names := []string{"b/page.json", "a.json", "a/c/d.json"}
+	SortNames(names)
 
-	sha, err := TarCompressDirectory(dirName, tarName)
+	var archive bytes.Buffer
+	assert.NoError(t, CompressDir(&archive, ""))
+	dirs := make(map[string]bool)
+	for _, name := range names {
+		for _, dir := range Parents(name, dirs) {
+			assert.NoError(t, CompressDir(&archive, dir))
+		}
+		archive.Write(members[name])
+	}
+	assert.NoError(t, CompressEnd(&archive))
+
+	zr, err := gzip.NewReader(&archive)
 	assert.NoError(t, err)
-	info, err := os.Stat(tarName)
+	plain, err := ioutil.ReadAll(zr)
 	assert.NoError(t, err)
-	assert.Equal(t, int64(158), info.Size(), "Tar file size")
-	assert.Equal(t, "986859044806a7e6cad8adeda2740cb081ebf895673c9bf9d3dbbf344d419bd5", sha, "Sha of tar file")
+	assert.True(t, bytes.HasSuffix(plain, make([]byte, 2*blockSize)), "The archive ends with two zero blocks")
+	tr := tar.NewReader(bytes.NewReader(plain))
+	type entry struct {
+		name string
+		mode int64
+		data string
+	}
+	var entries []entry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		b, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), hdr.ModTime.Unix())
+		entries = append(entries, entry{hdr.Name, hdr.Mode, string(b)})
+	}
+	assert.Equal(t, []entry{
+		{"./", 0700, ""},
+		{"/a", 0755, ""},
+		{"/a/c", 0755, ""},
+		{"/a/c/d.json", 0644, "acd"},
+		{"/a.json", 0644, files["a.json"]},
+		{"/b", 0755, ""},
+		{"/b/page.json", 0644, "b"},
+	}, entries)
 }
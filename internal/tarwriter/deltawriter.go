@@ -0,0 +1,248 @@
+package tarwriter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/canonical"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/governance"
+)
+
+// deltaName is the entry listing the deleted objects and the hashes of all current objects
+const deltaName = "delta.json"
+
+// deltaWriter uploads only the objects that were added or changed since the last
+// successful upload. The sha256 of every object, keyed by its Tower URL, is kept
+// in a local state file so deleted objects can be reported as well.
+type deltaWriter struct {
+	*tarWriter
+	statePath string
+	previous  map[string]string // object sha256 from the last successful upload, nil if there is none
+	current   map[string]string // object sha256 collected in this task
+}
+
+type deltaState struct {
+	Objects map[string]string `json:"objects"`
+}
+
+// MakeDeltaWriter creates a common.PageWriter that uploads a tar file with the objects
+// changed since the last upload. The first upload contains all objects.
+func MakeDeltaWriter(ctx context.Context, task catalogtask.CatalogTask, input common.RequestInput, metadata map[string]string) (common.PageWriter, error) {
+	pw, err := MakeTarWriter(ctx, task, input, metadata)
+	if err != nil {
+		return nil, err
+	}
+	dw := &deltaWriter{tarWriter: pw.(*tarWriter), current: make(map[string]string)}
+	dw.statePath = filepath.Join(common.StateDir(), "delta", deltaScope(input.Jobs)+".json")
+	dw.previous, err = loadDeltaState(dw.statePath)
+	if err != nil {
+		dw.glog.Errorf("Error loading the previous object hashes from %s, uploading all objects %v", dw.statePath, err)
+	}
+	return dw, nil
+}
+
+// deltaScope identifies the set of jobs so tasks collecting different objects keep separate states
+func deltaScope(jobs []common.JobParam) string {
+	var keys []string
+	for _, j := range jobs {
+		keys = append(keys, strings.ToLower(j.Method)+" "+j.HrefSlug)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(keys, "\n"))))
+}
+
+func loadDeltaState(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state deltaState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return state.Objects, nil
+}
+
+func saveDeltaState(path string, objects map[string]string) error {
+	b, err := json.Marshal(deltaState{Objects: objects})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Write keeps only the added or changed objects of a page. Objects in the results
+// of a list page are identified by their url, any other page is a single object.
+// The data policy manifest describes this task and not an object, it is always kept.
+func (dw *deltaWriter) Write(name string, b []byte) error {
+	if name == governance.ManifestName {
+		return dw.tarWriter.Write(name, b)
+	}
+	var page map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&page); err != nil {
+		dw.glog.Errorf("Error decoding page %s %v", name, err)
+		return err
+	}
+
+	results, ok := page["results"].([]interface{})
+	if !ok {
+		if dw.track(objectKey(page, name), page) {
+			return dw.tarWriter.Write(name, b)
+		}
+		return nil
+	}
+
+	var changed []interface{}
+	for i, o := range results {
+		if dw.track(objectKey(o, fmt.Sprintf("%s#%d", name, i)), o) {
+			changed = append(changed, o)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	page["results"] = changed
+	b, err := canonical.Marshal(page)
+	if err != nil {
+		dw.glog.Errorf("Error marshaling page %s %v", name, err)
+		return err
+	}
+	return dw.tarWriter.Write(name, b)
+}
+
+// track records the sha256 of an object and reports if it was added or changed
+func (dw *deltaWriter) track(key string, object interface{}) bool {
+	b, err := canonical.Marshal(object)
+	if err != nil {
+		dw.glog.Errorf("Error marshaling object %s %v", key, err)
+		return true
+	}
+	sha := fmt.Sprintf("%x", sha256.Sum256(b))
+	dw.current[key] = sha
+	return dw.previous[key] != sha
+}
+
+func objectKey(object interface{}, fallback string) string {
+	if m, ok := object.(map[string]interface{}); ok {
+		if url, ok := m["url"].(string); ok && url != "" {
+			return url
+		}
+	}
+	return fallback
+}
+
+// deleted returns the objects of the last upload that were not collected in this task
+func (dw *deltaWriter) deleted() []string {
+	deleted := []string{}
+	for key := range dw.previous {
+		if _, ok := dw.current[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted
+}
+
+// hasObjects reports if an added or changed object was kept, the data policy manifest does not count
+func (dw *deltaWriter) hasObjects() bool {
+	for name := range dw.pages {
+		if name != governance.ManifestName {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush uploads the changed objects together with the list of deleted objects and the
+// hashes of all current objects. The local state is only replaced after a successful upload.
+func (dw *deltaWriter) Flush() error {
+	deleted := dw.deleted()
+	if !dw.hasObjects() && len(deleted) == 0 && dw.previous != nil {
+		dw.cleanup()
+		return dw.unchanged()
+	}
+	if err := dw.writeDelta(deleted); err != nil {
+		return err
+	}
+	if err := dw.tarWriter.Flush(); err != nil {
+		return err
+	}
+	dw.saveState()
+	return nil
+}
+
+// FlushPartial uploads the changed objects of the successful jobs. The objects of the failed
+// jobs were not collected, they keep their previous hashes instead of being reported as deleted.
+func (dw *deltaWriter) FlushPartial(errors []common.JobError) error {
+	for key, sha := range dw.previous {
+		if _, ok := dw.current[key]; !ok {
+			dw.current[key] = sha
+		}
+	}
+	if err := dw.writeDelta([]string{}); err != nil {
+		return err
+	}
+	if err := dw.tarWriter.FlushPartial(errors); err != nil {
+		return err
+	}
+	dw.saveState()
+	return nil
+}
+
+// writeDelta adds the delta entry to the tar file
+func (dw *deltaWriter) writeDelta(deleted []string) error {
+	base := ""
+	if dw.previous != nil {
+		b, err := json.Marshal(dw.previous)
+		if err != nil {
+			return err
+		}
+		base = fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+	delta := map[string]interface{}{
+		"full":    dw.previous == nil,
+		"base":    base,
+		"deleted": deleted,
+		"objects": dw.current,
+	}
+	b, err := json.Marshal(delta)
+	if err != nil {
+		dw.glog.Errorf("Error marshaling the delta %v", err)
+		return err
+	}
+	return dw.tarWriter.Write(deltaName, b)
+}
+
+// saveState keeps the hashes of the uploaded objects. A queued tar file might never be
+// uploaded, the next task sends the changes since the last upload again instead.
+func (dw *deltaWriter) saveState() {
+	if dw.queued {
+		dw.glog.Info("Tar file queued, the object hashes of the last upload are kept")
+		return
+	}
+	if err := saveDeltaState(dw.statePath, dw.current); err != nil {
+		dw.glog.Errorf("Error saving the object hashes to %s %v", dw.statePath, err)
+	}
+}
@@ -0,0 +1,238 @@
+package tarwriter
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/governance"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// uploadServer accepts uploads and keeps the entries of the last uploaded tar file
+type uploadServer struct {
+	*httptest.Server
+	uploads int
+	entries map[string]string
+}
+
+func makeUploadServer(t *testing.T) *uploadServer {
+	us := &uploadServer{}
+	us.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		us.uploads++
+		us.entries = readUploadedTar(t, r)
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write([]byte(`{"upload":"accepted"}`))
+		assert.NoError(t, err)
+	}))
+	return us
+}
+
+func readUploadedTar(t *testing.T, r *http.Request) map[string]string {
+	entries := make(map[string]string)
+	reader, err := r.MultipartReader()
+	if !assert.NoError(t, err) {
+		return entries
+	}
+	part, err := reader.NextPart()
+	if !assert.NoError(t, err) {
+		return entries
+	}
+	zr, err := gzip.NewReader(part)
+	if !assert.NoError(t, err) {
+		return entries
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		b, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			entries[hdr.Name] = string(b)
+		}
+	}
+	return entries
+}
+
+func runDelta(t *testing.T, url string, page string) *mockCatalogTask {
+	task := new(mockCatalogTask)
+	task.On("Update", mock.Anything).Return(nil)
+	input := common.RequestInput{UploadURL: url, Jobs: []common.JobParam{{Method: "get", HrefSlug: "/api/v2/job_templates"}}}
+	pw, err := MakeDeltaWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, map[string]string{"task_url": "taskURL"})
+	assert.NoError(t, err)
+	assert.NoError(t, pw.Write("/api/v2/job_templates/page1.json", []byte(page)))
+	assert.NoError(t, pw.Flush())
+	return task
+}
+
+func TestDeltaWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	viper.Set("worker.state_dir", dir)
+	defer viper.Set("worker.state_dir", "")
+
+	us := makeUploadServer(t)
+	defer us.Close()
+
+	// first upload contains all objects
+	runDelta(t, us.URL, `{"results":[{"url":"/jt/1/","name":"a"},{"url":"/jt/2/","name":"b"},{"url":"/jt/3/","name":"c"}]}`)
+	assert.Equal(t, 1, us.uploads)
+	assert.Equal(t, `{"results":[{"name":"a","url":"/jt/1/"},{"name":"b","url":"/jt/2/"},{"name":"c","url":"/jt/3/"}]}`, us.entries["/api/v2/job_templates/page1.json"])
+	var delta map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(us.entries["/delta.json"]), &delta))
+	assert.Equal(t, true, delta["full"])
+	assert.Equal(t, []interface{}{}, delta["deleted"])
+
+	// second upload contains the changed object and the deleted one
+	runDelta(t, us.URL, `{"results":[{"url":"/jt/1/","name":"a"},{"url":"/jt/2/","name":"b2"}]}`)
+	assert.Equal(t, 2, us.uploads)
+	assert.Equal(t, `{"results":[{"name":"b2","url":"/jt/2/"}]}`, us.entries["/api/v2/job_templates/page1.json"])
+	assert.NoError(t, json.Unmarshal([]byte(us.entries["/delta.json"]), &delta))
+	assert.Equal(t, false, delta["full"])
+	assert.NotEmpty(t, delta["base"])
+	assert.Equal(t, []interface{}{"/jt/3/"}, delta["deleted"])
+	assert.Equal(t, 2, len(delta["objects"].(map[string]interface{})))
+
+	// nothing changed so nothing is uploaded
+	task := runDelta(t, us.URL, `{"results":[{"url":"/jt/2/","name":"b2"},{"url":"/jt/1/","name":"a"}]}`)
+	assert.Equal(t, 2, us.uploads)
+	task.AssertCalled(t, "Update", map[string]interface{}{"state": "completed", "status": "unchanged", "message": "Upload skipped since nothing has changed from last refresh"})
+}
+
+func TestDeltaDataPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	viper.Set("worker.state_dir", dir)
+	defer viper.Set("worker.state_dir", "")
+
+	us := makeUploadServer(t)
+	defer us.Close()
+
+	policy := `{"dropped":[],"policy_sha256":"abc"}`
+	run := func(page string) *mockCatalogTask {
+		task := new(mockCatalogTask)
+		task.On("Update", mock.Anything).Return(nil)
+		input := common.RequestInput{UploadURL: us.URL, Jobs: []common.JobParam{{Method: "get", HrefSlug: "/api/v2/job_templates"}}}
+		pw, err := MakeDeltaWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, map[string]string{"task_url": "taskURL"})
+		assert.NoError(t, err)
+		assert.NoError(t, pw.Write("/api/v2/job_templates/page1.json", []byte(page)))
+		assert.NoError(t, pw.Write(governance.ManifestName, []byte(policy)))
+		assert.NoError(t, pw.Flush())
+		return task
+	}
+
+	run(`{"results":[{"url":"/jt/1/","name":"a"},{"url":"/jt/2/","name":"b"}]}`)
+	assert.Equal(t, 1, us.uploads)
+	assert.Equal(t, policy, us.entries["/"+governance.ManifestName])
+
+	// the unchanged policy manifest is still in the tar file with the changed object
+	run(`{"results":[{"url":"/jt/1/","name":"a"},{"url":"/jt/2/","name":"b2"}]}`)
+	assert.Equal(t, 2, us.uploads)
+	assert.Equal(t, policy, us.entries["/"+governance.ManifestName])
+	assert.Equal(t, `{"results":[{"name":"b2","url":"/jt/2/"}]}`, us.entries["/api/v2/job_templates/page1.json"])
+
+	// the policy manifest alone is not a change
+	task := run(`{"results":[{"url":"/jt/1/","name":"a"},{"url":"/jt/2/","name":"b2"}]}`)
+	assert.Equal(t, 2, us.uploads)
+	task.AssertCalled(t, "Update", map[string]interface{}{"state": "completed", "status": "unchanged", "message": "Upload skipped since nothing has changed from last refresh"})
+}
+
+func TestDeltaStateKeptOnFailedUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	viper.Set("worker.state_dir", dir)
+	defer viper.Set("worker.state_dir", "")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	task := new(mockCatalogTask)
+	task.On("Update", mock.Anything).Return(nil)
+	pw, err := MakeDeltaWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: ts.URL}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, pw.Write("/api/v2/job_templates/page1.json", []byte(`{"results":[{"url":"/jt/1/"}]}`)))
+	assert.Error(t, pw.Flush())
+
+	files, _ := ioutil.ReadDir(dir + "/delta")
+	assert.Empty(t, files)
+}
+
+func TestDeltaStateKeptOnQueuedUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	viper.Set("worker.state_dir", dir)
+	defer viper.Set("worker.state_dir", "")
+	o := useTestOutbox(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	task := new(mockCatalogTask)
+	task.On("Update", mock.Anything).Return(nil)
+	pw, err := MakeDeltaWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: ts.URL}, map[string]string{"task_url": "taskURL"})
+	assert.NoError(t, err)
+	assert.NoError(t, pw.Write("/api/v2/job_templates/page1.json", []byte(`{"results":[{"url":"/jt/1/"}]}`)))
+	assert.NoError(t, pw.Flush())
+	assert.Equal(t, 1, len(o.Pending()))
+
+	files, _ := ioutil.ReadDir(dir + "/delta")
+	assert.Empty(t, files, "The hashes are only saved after the upload")
+}
+
+func TestDeltaPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	viper.Set("worker.state_dir", dir)
+	defer viper.Set("worker.state_dir", "")
+
+	us := makeUploadServer(t)
+	defer us.Close()
+	runDelta(t, us.URL, `{"results":[{"url":"/jt/1/","name":"a"},{"url":"/jt/2/","name":"b"}]}`)
+
+	// the job collecting /jt/2/ failed, it must not be reported as deleted
+	task := new(mockCatalogTask)
+	task.On("Update", mock.Anything).Return(nil)
+	input := common.RequestInput{UploadURL: us.URL, Jobs: []common.JobParam{{Method: "get", HrefSlug: "/api/v2/job_templates"}}}
+	pw, err := MakeDeltaWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, pw.Write("/api/v2/job_templates/page1.json", []byte(`{"results":[{"url":"/jt/1/","name":"a1"}]}`)))
+	assert.NoError(t, pw.FlushPartial([]common.JobError{{Href: "/jt/2/", Method: "get", HTTPStatus: 404, Message: "Not Found"}}))
+
+	assert.Equal(t, 2, us.uploads)
+	var delta map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(us.entries["/delta.json"]), &delta))
+	assert.Equal(t, []interface{}{}, delta["deleted"])
+	assert.Equal(t, 2, len(delta["objects"].(map[string]interface{})))
+	assert.Contains(t, us.entries["/errors.json"], `"href":"/jt/2/"`)
+
+	// the next complete run still sees the deletion
+	runDelta(t, us.URL, `{"results":[{"url":"/jt/1/","name":"a1"}]}`)
+	assert.NoError(t, json.Unmarshal([]byte(us.entries["/delta.json"]), &delta))
+	assert.Equal(t, []interface{}{"/jt/2/"}, delta["deleted"])
+}
@@ -0,0 +1,160 @@
+package tarwriter
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/encryption"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+)
+
+// useTestRecipient enables encryption to a new key and returns its private key
+func useTestRecipient(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "recipient")
+	assert.NoError(t, err)
+	file := filepath.Join(dir, "recipient.pem")
+	assert.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	viper.Set("worker.encryption.enabled", true)
+	viper.Set("worker.encryption.recipients", []string{file})
+	t.Cleanup(func() {
+		viper.Set("worker.encryption.enabled", nil)
+		viper.Set("worker.encryption.recipients", nil)
+		os.RemoveAll(dir)
+	})
+	return key
+}
+
+func TestUploadEncrypted(t *testing.T) {
+	key := useTestRecipient(t)
+	var uploaded []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if assert.NoError(t, err) {
+			part, err := reader.NextPart()
+			if assert.NoError(t, err) {
+				uploaded, _ = ioutil.ReadAll(part)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, err = w.Write([]byte(`{"upload":"accepted"}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	task := new(mockCatalogTask)
+	var update map[string]interface{}
+	task.On("Update", mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(0).(map[string]interface{})
+	}).Return(nil)
+	twriter, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: ts.URL}, map[string]string{"task_url": "taskURL"})
+	shareWriteOperation(t, twriter)
+	assert.NoError(t, twriter.Flush())
+
+	assert.Equal(t, "ok", update["status"])
+	output := *update["output"].(*map[string]interface{})
+	assert.Equal(t, "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1", output["sha256"], "The sha256 of the plain tar file is reported")
+	assert.Equal(t, int64(414), output["tar_size"])
+	envelope := output["encryption"].(*encryption.Envelope)
+	assert.Equal(t, encryption.Scheme, envelope.Scheme)
+	sum := sha256.Sum256(uploaded)
+	assert.Equal(t, hex.EncodeToString(sum[:]), envelope.SHA256)
+
+	plain := decrypt(t, uploaded, *envelope, key)
+	plainSum := sha256.Sum256(plain)
+	assert.Equal(t, output["sha256"], hex.EncodeToString(plainSum[:]))
+}
+
+// decrypt opens an archive the way a recipient does, by the scheme of the envelope: the archive
+// key is unwrapped with RSA-OAEP SHA-256 and every AES-GCM chunk is opened with its counter as the
+// nonce, the last chunk is marked in the last byte of its nonce
+func decrypt(t *testing.T, sealed []byte, env encryption.Envelope, key *rsa.PrivateKey) []byte {
+	assert.Equal(t, encryption.Scheme, env.Scheme)
+	if !assert.Equal(t, 1, len(env.Recipients)) {
+		return nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(env.Recipients[0].WrappedKey)
+	assert.NoError(t, err)
+	archiveKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, wrapped, nil)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	block, err := aes.NewCipher(archiveKey)
+	assert.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	assert.NoError(t, err)
+
+	var plain []byte
+	sealedSize := env.ChunkSize + aead.Overhead()
+	for counter := uint64(0); ; counter++ {
+		chunk := sealed
+		if len(chunk) > sealedSize {
+			chunk = chunk[:sealedSize]
+		}
+		sealed = sealed[len(chunk):]
+		nonce := make([]byte, aead.NonceSize())
+		binary.BigEndian.PutUint64(nonce[3:11], counter)
+		if len(sealed) == 0 {
+			nonce[11] = 1
+		}
+		opened, err := aead.Open(nil, nonce, chunk, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		plain = append(plain, opened...)
+		if len(sealed) == 0 {
+			return plain
+		}
+	}
+}
+
+func TestNoUploadEncrypted(t *testing.T) {
+	useTestRecipient(t)
+	task := new(mockCatalogTask)
+	input := common.RequestInput{PreviousSHA: "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1", PreviousSize: int64(414)}
+	writer, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, map[string]string{"task_url": "taskURL"})
+	shareWriteOperation(t, writer)
+
+	shareFlushTest(t, writer.(*tarWriter), nil, "unchanged", "", "Upload skipped since nothing has changed from last refresh")
+}
+
+func TestEncryptionMisconfigured(t *testing.T) {
+	viper.Set("worker.encryption.enabled", true)
+	defer viper.Set("worker.encryption.enabled", nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Nothing is uploaded without recipients")
+	}))
+	defer ts.Close()
+
+	task := new(mockCatalogTask)
+	task.On("Update", mock.MatchedBy(func(update map[string]interface{}) bool {
+		return update["status"] == "error"
+	})).Return(nil)
+	twriter, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: ts.URL}, map[string]string{"task_url": "taskURL"})
+	shareWriteOperation(t, twriter)
+	assert.Error(t, twriter.Flush())
+	task.AssertExpectations(t)
+}
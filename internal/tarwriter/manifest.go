@@ -0,0 +1,40 @@
+package tarwriter
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// manifestName is the entry that lists the sha256 and size of every page in the tar file
+const manifestName = "manifest.json"
+
+// errorsName is the entry that lists the failed jobs of a partial upload
+const errorsName = "errors.json"
+
+type manifestEntry struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// manifest lists all pages in the order they are added to the tar file. It only depends on
+// the names and contents of the pages so it detects unchanged inventories reliably.
+func (tw *tarWriter) manifest() ([]byte, error) {
+	names := tw.names()
+	entries := make([]manifestEntry, 0, len(names))
+	for _, name := range names {
+		p := tw.pages[name]
+		entries = append(entries, manifestEntry{Name: name, SHA256: p.sha256, Size: p.size})
+	}
+	return json.Marshal(map[string]interface{}{"files": entries})
+}
+
+// contentSHA returns the sha256 of the manifest
+func (tw *tarWriter) contentSHA() (string, error) {
+	b, err := tw.manifest()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
@@ -0,0 +1,71 @@
+package tarwriter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spillBuffer keeps the written data in memory until it grows beyond
+// limit bytes, after that all data is moved to a temp file
+type spillBuffer struct {
+	limit int64
+	size  int64
+	buf   bytes.Buffer
+	file  *os.File
+}
+
+func (sb *spillBuffer) Write(b []byte) (int, error) {
+	if sb.file == nil && int64(sb.buf.Len()+len(b)) > sb.limit {
+		f, err := ioutil.TempFile("", "catalog_client_tgz")
+		if err != nil {
+			return 0, err
+		}
+		sb.file = f
+		if _, err := sb.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if sb.file != nil {
+		n, err = sb.file.Write(b)
+	} else {
+		n, err = sb.buf.Write(b)
+	}
+	sb.size += int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes written
+func (sb *spillBuffer) Len() int64 {
+	return sb.size
+}
+
+// ReaderAt returns the written data for random access
+func (sb *spillBuffer) ReaderAt() io.ReaderAt {
+	if sb.file == nil {
+		return bytes.NewReader(sb.buf.Bytes())
+	}
+	return sb.file
+}
+
+// spilled reports if the data was moved to a temp file
+func (sb *spillBuffer) spilled() bool {
+	return sb.file != nil
+}
+
+// Close releases the memory and removes the temp file
+func (sb *spillBuffer) Close() error {
+	sb.buf.Reset()
+	sb.size = 0
+	if sb.file == nil {
+		return nil
+	}
+	name := sb.file.Name()
+	err := sb.file.Close()
+	os.Remove(name)
+	sb.file = nil
+	return err
+}
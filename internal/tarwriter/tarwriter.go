@@ -1,66 +1,204 @@
 package tarwriter
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/catalogtask"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/encryption"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/outbox"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/tarfiles"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/upload"
+	"github.com/spf13/viper"
 )
 
+const defaultMemoryLimitMB = 64
+
+// PendingUploadStatus is reported to a task when its tar file is queued in the outbox,
+// the outbox completes the task once the tar file is uploaded
+const PendingUploadStatus = "pending_upload"
+
+// pendingUploads keeps the tar files that failed to upload, nil if store and forward is disabled
+var pendingUploads *outbox.Outbox
+
+// UseOutbox queues the tar files that fail to upload with a retryable error in o
+func UseOutbox(o *outbox.Outbox) {
+	pendingUploads = o
+}
+
+// tarWriter compresses every page as it arrives and keeps the compressed entries in
+// memory, they are moved to a temp file after the memory limit is exceeded. The tar
+// file is joined from the compressed entries during Flush, its sha256 is computed
+// while it is written.
 type tarWriter struct {
-	dir      string
-	task     catalogtask.CatalogTask
-	input    common.RequestInput
-	ctx      context.Context
-	glog     logger.Logger
-	metadata map[string]string
+	entries     *spillBuffer    // compressed entries of the pages in the order they arrived
+	pages       map[string]page // where the compressed entry of every page is in entries
+	memoryLimit int64
+	task        catalogtask.CatalogTask
+	input       common.RequestInput
+	ctx         context.Context
+	glog        logger.Logger
+	metadata    map[string]string
+	phase       func(string)           // reports the phase of a flush
+	queued      bool                   // the tar file is waiting in the outbox
+	recipients  []encryption.Recipient // the uploaded tar file is encrypted to them, none if encryption is disabled
+}
+
+// page locates the compressed entry of a page, an entry of a page that was
+// written again stays in entries unused
+type page struct {
+	offset int64
+	length int64
+	size   int64  // size of the page before it was compressed
+	sha256 string // sha256 of the page before it was compressed
 }
 
 // MakeTarWriter creates a common.PageWriter that zip data as a tar file and upload to an URL.
 func MakeTarWriter(ctx context.Context, task catalogtask.CatalogTask, input common.RequestInput, metadata map[string]string) (common.PageWriter, error) {
 	glog := logger.GetLogger(ctx)
 	t := tarWriter{}
-	dir, err := ioutil.TempDir("", "catalog_client")
-	if err != nil {
-		glog.Errorf("Error creating temp directory %v", err)
-		return nil, err
+	t.pages = make(map[string]page)
+	t.memoryLimit = viper.GetInt64("worker.tar.memory_limit_mb") * 1024 * 1024
+	if t.memoryLimit <= 0 {
+		t.memoryLimit = defaultMemoryLimitMB * 1024 * 1024
 	}
-	t.dir = dir
+	t.entries = &spillBuffer{limit: t.memoryLimit}
 	t.task = task
 	t.input = input
 	t.ctx = ctx
 	t.glog = glog
 	t.metadata = metadata
+	t.phase = func(string) {}
 	return &t, nil
 }
 
+// ObservePhase sets the function called when a flush starts compressing or uploading
+func (tw *tarWriter) ObservePhase(f func(phase string)) {
+	tw.phase = f
+}
+
 // Write a Page given the name and the number of bytes to write
 func (tw *tarWriter) Write(name string, b []byte) error {
-	baseDir := filepath.Join(tw.dir, filepath.Dir(name))
-	err := os.MkdirAll(baseDir, os.ModePerm)
-	if err != nil {
-		tw.glog.Errorf("Error creating directory %s %v", baseDir, err)
+	tw.glog.Infof("adding page %s", name)
+	spilled := tw.entries.spilled()
+	offset := tw.entries.Len()
+	if err := tarfiles.CompressFile(tw.entries, name, bytes.NewReader(b), int64(len(b))); err != nil {
+		tw.glog.Errorf("Error compressing page %s %v", name, err)
 		return err
 	}
-	tw.glog.Infof("adding file %s", filepath.Join(tw.dir, name))
-	err = ioutil.WriteFile(filepath.Join(tw.dir, name), b, 0644)
-	if err != nil {
-		tw.glog.Errorf("Error writing file %s %v", name, err)
-		return err
+	if !spilled && tw.entries.spilled() {
+		tw.glog.Infof("Memory limit of %d bytes exceeded, compressed pages staged on disk", tw.memoryLimit)
+	}
+	tw.pages[name] = page{
+		offset: offset,
+		length: tw.entries.Len() - offset,
+		size:   int64(len(b)),
+		sha256: fmt.Sprintf("%x", sha256.Sum256(b)),
 	}
 	return nil
 }
 
+// cleanup releases the compressed pages and removes their temp file
+func (tw *tarWriter) cleanup() {
+	tw.pages = make(map[string]page)
+	tw.entries.Close()
+}
+
+// names returns the names of all pages in the order they are added to the tar file
+func (tw *tarWriter) names() []string {
+	names := make([]string, 0, len(tw.pages))
+	for name := range tw.pages {
+		names = append(names, name)
+	}
+	tarfiles.SortNames(names)
+	return names
+}
+
+// writeArchive joins the compressed pages, their directories and the manifest to a
+// compressed tar stream in a deterministic order and returns the sha256 and size of the
+// stream. The pages were compressed as they arrived, they are only copied here.
+func (tw *tarWriter) writeArchive(out io.Writer) (string, int64, error) {
+	manifest, err := tw.manifest()
+	if err != nil {
+		return "", 0, err
+	}
+	names := append(tw.names(), manifestName)
+	tarfiles.SortNames(names)
+
+	hash := sha256.New()
+	var size countWriter
+	w := io.MultiWriter(out, hash, &size)
+	if err := tarfiles.CompressDir(w, ""); err != nil {
+		return "", 0, err
+	}
+	dirs := make(map[string]bool)
+	for _, name := range names {
+		for _, dir := range tarfiles.Parents(name, dirs) {
+			if err := tarfiles.CompressDir(w, dir); err != nil {
+				return "", 0, err
+			}
+		}
+		if name == manifestName {
+			err = tarfiles.CompressFile(w, name, bytes.NewReader(manifest), int64(len(manifest)))
+		} else {
+			p := tw.pages[name]
+			_, err = io.Copy(w, io.NewSectionReader(tw.entries.ReaderAt(), p.offset, p.length))
+		}
+		if err != nil {
+			tw.glog.Errorf("Error adding page %s %v", name, err)
+			return "", 0, err
+		}
+	}
+	if err := tarfiles.CompressEnd(w); err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), int64(size), nil
+}
+
+type countWriter int64
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	*c += countWriter(len(b))
+	return len(b), nil
+}
+
+// Flush uploads the pages as a compressed tar file. The tar file is streamed straight
+// into the upload request while it is hashed. When the task carries the sha of the
+// previous upload the tar file is hashed first, from the compressed pages without
+// storing it, to skip unchanged uploads.
+// The sha of the previous manifest is preferred since it does not need the tar file at all.
 func (tw *tarWriter) Flush() error {
-	defer os.RemoveAll(tw.dir)
-	var statusErrors []string
+	return tw.flush(nil)
+}
+
+// FlushPartial uploads the pages collected by the successful jobs with the errors of
+// the failed jobs listed in errors.json. The task is completed with the partial status.
+func (tw *tarWriter) FlushPartial(errors []common.JobError) error {
+	b, err := json.Marshal(map[string]interface{}{"errors": errors})
+	if err != nil {
+		tw.glog.Errorf("Error marshaling the errors %v", err)
+		return err
+	}
+	if err := tw.Write(errorsName, b); err != nil {
+		return err
+	}
+	return tw.flush(errors)
+}
+
+// flush uploads the tar file, partialErrors are only set for a partial upload which
+// is never skipped as unchanged so the errors reach the task
+func (tw *tarWriter) flush(partialErrors []common.JobError) error {
+	defer tw.cleanup()
+	var statusErrors []common.JobError
 	defer func() {
 		if len(statusErrors) > 0 {
 			err := tw.FlushErrors(statusErrors)
@@ -70,50 +208,240 @@ func (tw *tarWriter) Flush() error {
 		}
 	}()
 
-	tmpdir, err := ioutil.TempDir("", "catalog_client_tgz")
+	contentSHA, err := tw.contentSHA()
 	if err != nil {
-		tw.glog.Errorf("Error creating temp directory %v", err)
-		statusErrors = append(statusErrors, "Failed to create temp directory for the tar file creation")
+		tw.glog.Errorf("Error creating the manifest %v", err)
+		statusErrors = append(statusErrors, tw.uploadError("Failed to create the manifest of the tar file", false))
 		return err
 	}
-	defer os.RemoveAll(tmpdir)
-
-	fname := filepath.Join(tmpdir, "inventory.tgz")
-	sha, err := tarfiles.TarCompressDirectory(tw.dir, fname)
-	if err != nil {
-		tw.glog.Errorf("Error compressing directory %s %v", tw.dir, err)
-		statusErrors = append(statusErrors, "Failed to compress directory to a tar file")
-		return err
-	}
-	info, _ := os.Stat(fname)
-
-	if sha == tw.input.PreviousSHA && info.Size() == tw.input.PreviousSize {
-		err = tw.task.Update(map[string]interface{}{"state": "completed", "status": "unchanged", "message": "Upload skipped since nothing has changed from last refresh"})
+	if partialErrors != nil {
+		tw.glog.Infof("Uploading partial results with %d errors", len(partialErrors))
+	} else if tw.input.PreviousContentSHA != "" {
+		if contentSHA == tw.input.PreviousContentSHA {
+			return tw.unchanged()
+		}
+	} else if tw.input.PreviousSHA != "" {
+		tw.phase("compressing")
+		sha, size, err := tw.writeArchive(ioutil.Discard)
 		if err != nil {
-			tw.glog.Errorf("Error updating task: %v", err)
+			tw.glog.Errorf("Error compressing pages %v", err)
+			statusErrors = append(statusErrors, tw.uploadError("Failed to compress directory to a tar file", false))
 			return err
 		}
-		return nil
+
+		if sha == tw.input.PreviousSHA && size == tw.input.PreviousSize {
+			return tw.unchanged()
+		}
 	}
 
-	b, uploadErr := upload.Upload(tw.input.UploadURL, fname, "application/vnd.redhat.catalog.filename+tgz", tw.metadata)
+	tw.recipients, err = encryption.Configured()
+	if err != nil {
+		tw.glog.Errorf("Error loading the encryption recipients %v", err)
+		statusErrors = append(statusErrors, tw.uploadError("Failed to load the encryption recipients", false))
+		return err
+	}
+
+	tw.phase("uploading")
+	b, sha, size, envelope, uploadErr := tw.upload()
 	if uploadErr != nil {
-		tw.glog.Errorf("Error uploading file %s %v", fname, uploadErr)
-		statusErrors = append(statusErrors, "Failed to upload the tar file")
+		tw.glog.Errorf("Error uploading tar file %v", uploadErr)
+		if upload.Retryable(uploadErr) && pendingUploads != nil {
+			if err := tw.queue(contentSHA, partialErrors); err == nil {
+				return nil
+			}
+		}
+		statusErrors = append(statusErrors, tw.uploadError("Failed to upload the tar file", true))
 		return uploadErr
 	}
 	var m map[string]interface{}
 	err = json.Unmarshal(b, &m)
 	if err != nil {
 		tw.glog.Errorf("Unmarshaling byte array for %v", err)
-		statusErrors = append(statusErrors, "Failed to unmarshal the body of uploading API call")
+		statusErrors = append(statusErrors, tw.uploadError("Failed to unmarshal the body of uploading API call", false))
 		return err
 	}
 
-	output := map[string]interface{}{"ingress": m, "sha256": sha, "tar_size": info.Size()}
+	output := map[string]interface{}{"ingress": m, "sha256": sha, "tar_size": size, "content_sha256": contentSHA}
+	if envelope != nil {
+		output["encryption"] = envelope
+	}
+	status, message := completion(output, partialErrors)
+	err = tw.task.Update(map[string]interface{}{"state": "completed", "status": status, "output": &output, "message": message})
 
-	err = tw.task.Update(map[string]interface{}{"state": "completed", "status": "ok", "output": &output, "message": "Catalog Worker Completed Successfully"})
+	if err != nil {
+		tw.glog.Errorf("Error updating task: %v", err)
+		return err
+	}
+	return nil
+}
 
+// completion returns the status and message of an uploaded task and adds the errors of a partial upload to the output
+func completion(output map[string]interface{}, partialErrors []common.JobError) (string, string) {
+	if partialErrors != nil {
+		output["errors"] = partialErrors
+		return "partial", "Catalog Worker Completed with errors, the data of the failed jobs is missing"
+	}
+	return "ok", "Catalog Worker Completed Successfully"
+}
+
+// queue stores the tar file in the outbox to be uploaded later and reports the pending upload to the task
+func (tw *tarWriter) queue(contentSHA string, partialErrors []common.JobError) error {
+	taskURL := tw.metadata["task_url"]
+	if taskURL == "" {
+		return errors.New("The task URL is missing")
+	}
+	var sha string
+	var size int64
+	md := tw.uploadMetadata()
+	output := map[string]interface{}{"content_sha256": contentSHA}
+	status, message := completion(output, partialErrors)
+	err := pendingUploads.Add(outbox.Upload{
+		TaskURL:   taskURL,
+		UploadURL: tw.input.UploadURL,
+		Metadata:  md,
+		Status:    status,
+		Message:   message,
+		Output:    output,
+	}, func(w io.Writer) error {
+		var err error
+		sha, size, md.Encryption, err = tw.writeUpload(w)
+		md.SHA256, md.Size = sha, size
+		output["sha256"] = sha
+		output["tar_size"] = size
+		if md.Encryption != nil {
+			output["encryption"] = md.Encryption
+		}
+		return err
+	})
+	if err != nil {
+		tw.glog.Errorf("Error queueing the tar file for a later upload %v", err)
+		return err
+	}
+	tw.queued = true
+	tw.glog.Infof("Tar file of %d bytes queued for a later upload", size)
+	pending := map[string]interface{}{"sha256": sha, "tar_size": size, "content_sha256": contentSHA}
+	if md.Encryption != nil {
+		pending["encryption"] = md.Encryption
+	}
+	err = tw.task.Update(map[string]interface{}{
+		"state":   "running",
+		"status":  PendingUploadStatus,
+		"message": "Upload failed, the tar file is queued to be uploaded again",
+		"output":  &pending,
+	})
+	if err != nil {
+		tw.glog.Errorf("Error updating task: %v", err)
+	}
+	return nil
+}
+
+// uploadError describes a failure to build or upload the tar file
+func (tw *tarWriter) uploadError(message string, retryable bool) common.JobError {
+	return common.JobError{Href: tw.input.UploadURL, Method: "upload", Message: message, Retryable: retryable, Timestamp: time.Now().UTC()}
+}
+
+// unchanged updates the task when the upload is skipped
+func (tw *tarWriter) unchanged() error {
+	err := tw.task.Update(map[string]interface{}{"state": "completed", "status": "unchanged", "message": "Upload skipped since nothing has changed from last refresh"})
+	if err != nil {
+		tw.glog.Errorf("Error updating task: %v", err)
+		return err
+	}
+	return nil
+}
+
+// upload streams the tar file into the upload request and returns the response body
+// with the sha256 and size of the tar file and the envelope of an encrypted tar file.
+// If the upload service rejects chunked transfer encoding the tar file is buffered and
+// uploaded with its content length. Resumable uploads need the whole tar file so it is
+// always buffered for them.
+func (tw *tarWriter) upload() ([]byte, string, int64, *encryption.Envelope, error) {
+	contentType := "application/vnd.redhat.catalog.filename+tgz"
+	if upload.ResumableEnabled() {
+		return tw.uploadBuffered(contentType)
+	}
+	var sha string
+	var size int64
+	md := tw.uploadMetadata()
+	b, err := upload.UploadStream(tw.input.UploadURL, func(w io.Writer) error {
+		var err error
+		sha, size, md.Encryption, err = tw.writeUpload(w)
+		md.SHA256, md.Size = sha, size
+		return err
+	}, contentType, md)
+	if err != upload.ErrChunkedRejected {
+		return b, sha, size, md.Encryption, err
+	}
+
+	tw.glog.Info("Chunked upload rejected, buffering the tar file")
+	return tw.uploadBuffered(contentType)
+}
+
+// uploadBuffered builds the tar file before it is uploaded, in memory up to the memory limit
+func (tw *tarWriter) uploadBuffered(contentType string) ([]byte, string, int64, *encryption.Envelope, error) {
+	tw.phase("compressing")
+	out := &spillBuffer{limit: tw.memoryLimit}
+	defer out.Close()
+	md := tw.uploadMetadata()
+	sha, size, envelope, err := tw.writeUpload(out)
+	if err != nil {
+		tw.glog.Errorf("Error compressing pages %v", err)
+		return nil, "", 0, nil, err
+	}
+	if out.spilled() {
+		tw.glog.Infof("Memory limit of %d bytes exceeded, tar file staged on disk", tw.memoryLimit)
+	}
+	tw.phase("uploading")
+	md.SHA256, md.Size, md.Encryption = sha, size, envelope
+	uploadSize := size
+	if envelope != nil {
+		uploadSize = envelope.Size
+	}
+	b, err := upload.UploadAt(tw.input.UploadURL, out.ReaderAt(), uploadSize, contentType, md)
+	return b, sha, size, envelope, err
+}
+
+// writeUpload writes the tar file as it is uploaded, encrypted if there are recipients. The sha256
+// and size of the plain tar file are returned so unchanged uploads are still detected.
+func (tw *tarWriter) writeUpload(out io.Writer) (string, int64, *encryption.Envelope, error) {
+	if len(tw.recipients) == 0 {
+		sha, size, err := tw.writeArchive(out)
+		return sha, size, nil, err
+	}
+	ew, err := encryption.NewWriter(out, tw.recipients)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	sha, size, err := tw.writeArchive(ew)
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	envelope := ew.Envelope()
+	return sha, size, &envelope, nil
+}
+
+// uploadMetadata describes the task and the jobs of the tar file, its sha256 and size are set once it is built
+func (tw *tarWriter) uploadMetadata() *upload.Metadata {
+	return &upload.Metadata{
+		TaskURL:       tw.metadata["task_url"],
+		WorkerVersion: tw.metadata["worker_version"],
+		TowerUUID:     tw.metadata["tower_uuid"],
+		TowerName:     tw.metadata["tower_name"],
+		Jobs:          tw.input.Jobs,
+	}
+}
+
+// Abort discards the collected pages and updates the task with the given status
+func (tw *tarWriter) Abort(status string, message string, errors []common.JobError) error {
+	tw.cleanup()
+	update := map[string]interface{}{"state": "completed", "status": status, "message": message}
+	if len(errors) > 0 {
+		update["output"] = &map[string]interface{}{"errors": errors}
+	}
+	err := tw.task.Update(update)
 	if err != nil {
 		tw.glog.Errorf("Error updating task: %v", err)
 		return err
@@ -121,10 +449,11 @@ func (tw *tarWriter) Flush() error {
 	return nil
 }
 
-func (tw *tarWriter) FlushErrors(messages []string) error {
-	os.RemoveAll(tw.dir)
+// FlushErrors discards the collected pages and updates the task with the errors
+func (tw *tarWriter) FlushErrors(errors []common.JobError) error {
+	tw.cleanup()
 	msg := map[string]interface{}{
-		"errors": messages,
+		"errors": errors,
 	}
 	err := tw.task.Update(map[string]interface{}{"state": "completed", "status": "error", "output": &msg, "message": "Catalog Worker Ended with errors"})
 	if err != nil {
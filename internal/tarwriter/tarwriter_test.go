@@ -1,16 +1,29 @@
 package tarwriter
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/outbox"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/upload"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -44,18 +57,20 @@ func shareWriteOperation(t *testing.T, writer common.PageWriter) {
 	err := writer.Write("testpage", []byte(strings.Repeat("na", 512)))
 	assert.NoError(t, err)
 
-	// tar directory exists and contains 1 file
+	// compressed page is kept in memory
 	writerObj := writer.(*tarWriter)
-	if assert.DirExists(t, writerObj.dir) {
-		files, _ := ioutil.ReadDir(writerObj.dir)
-		assert.Equal(t, 1, len(files))
-	}
+	assert.Equal(t, 1, len(writerObj.pages))
+	assert.NotZero(t, writerObj.entries.Len())
+	assert.False(t, writerObj.entries.spilled())
 }
 
 func shareFlushTest(t *testing.T, writerObj *tarWriter, output *map[string]interface{}, status string, errMsg string, message string) {
 	task := writerObj.task.(*mockCatalogTask)
 	if output != nil {
-		task.On("Update", map[string]interface{}{"state": "completed", "status": status, "output": output, "message": message}).Return(nil)
+		expected := map[string]interface{}{"state": "completed", "status": status, "output": output, "message": message}
+		task.On("Update", mock.MatchedBy(func(update map[string]interface{}) bool {
+			return reflect.DeepEqual(expected, withoutTimestamps(update))
+		})).Return(nil)
 	} else {
 		task.On("Update", map[string]interface{}{"state": "completed", "status": status, "message": message}).Return(nil)
 	}
@@ -70,9 +85,37 @@ func shareFlushTest(t *testing.T, writerObj *tarWriter, output *map[string]inter
 		}
 	}
 
-	// tar directory removed
-	_, err = os.Stat(writerObj.dir)
-	assert.True(t, !os.IsExist(err))
+	// pages released
+	assert.Empty(t, writerObj.pages)
+	assert.Zero(t, writerObj.entries.Len())
+}
+
+// withoutTimestamps clears the timestamps of the errors in a task update
+func withoutTimestamps(update map[string]interface{}) map[string]interface{} {
+	output, ok := update["output"].(*map[string]interface{})
+	if !ok {
+		return update
+	}
+	errors, ok := (*output)["errors"].([]common.JobError)
+	if !ok {
+		return update
+	}
+	cleared := make([]common.JobError, len(errors))
+	for i, e := range errors {
+		e.Timestamp = time.Time{}
+		cleared[i] = e
+	}
+	copied := make(map[string]interface{})
+	for k, v := range *output {
+		copied[k] = v
+	}
+	copied["errors"] = cleared
+	result := make(map[string]interface{})
+	for k, v := range update {
+		result[k] = v
+	}
+	result["output"] = &copied
+	return result
 }
 
 func TestWriteAndFlush(t *testing.T) {
@@ -80,43 +123,382 @@ func TestWriteAndFlush(t *testing.T) {
 	defer ts.Close()
 
 	output := map[string]interface{}{
-		"ingress":  map[string]interface{}{"upload": "accepted"},
-		"sha256":   "8d97f6ddad8fb21b41a2d97079fbb371e590fc5c4afb9556faa9de1ba025d84c",
-		"tar_size": int64(134),
+		"ingress":        map[string]interface{}{"upload": "accepted"},
+		"sha256":         "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1",
+		"tar_size":       int64(414),
+		"content_sha256": "464acd3009606a354529fb4c5ac11b25dace97c07fdf4f9531847785f02d00e1",
 	}
 	shareFlushTest(t, writerObj, &output, "ok", "", "Catalog Worker Completed Successfully")
 }
 
+func TestObservePhase(t *testing.T) {
+	us := makeUploadServer(t)
+	defer us.Close()
+	task := new(mockCatalogTask)
+	task.On("Update", mock.Anything).Return(nil)
+	input := common.RequestInput{UploadURL: us.URL, PreviousSHA: "sha", PreviousSize: 10}
+	pw, err := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, nil)
+	assert.NoError(t, err)
+	var phases []string
+	pw.(common.PhaseObserver).ObservePhase(func(phase string) { phases = append(phases, phase) })
+	shareWriteOperation(t, pw)
+
+	assert.NoError(t, pw.Flush())
+	assert.Equal(t, []string{"compressing", "uploading"}, phases)
+}
+
+func TestFlushPartial(t *testing.T) {
+	us := makeUploadServer(t)
+	defer us.Close()
+	task := new(mockCatalogTask)
+	task.On("Update", mock.Anything).Return(nil)
+	input := common.RequestInput{UploadURL: us.URL, PreviousContentSHA: "464acd3009606a354529fb4c5ac11b25dace97c07fdf4f9531847785f02d00e1"}
+	pw, err := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, nil)
+	assert.NoError(t, err)
+	shareWriteOperation(t, pw)
+
+	timestamp := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	errors := []common.JobError{{Href: "/api/v2/job_templates/5/survey_spec", Method: "get", HTTPStatus: 404, Message: "Not Found", Detail: "Not found.", Attempts: 1, Timestamp: timestamp}}
+	assert.NoError(t, pw.FlushPartial(errors))
+	assert.Equal(t, 1, us.uploads, "Partial results are never skipped as unchanged")
+	assert.Equal(t, `{"errors":[{"href":"/api/v2/job_templates/5/survey_spec","method":"get","http_status":404,"message":"Not Found","detail":"Not found.","retryable":false,"attempts":1,"timestamp":"2021-03-01T12:00:00Z"}]}`, us.entries["/errors.json"])
+	assert.Contains(t, us.entries["/manifest.json"], `"name":"errors.json"`)
+
+	update := task.Calls[0].Arguments.Get(0).(map[string]interface{})
+	assert.Equal(t, "partial", update["status"])
+	output := *update["output"].(*map[string]interface{})
+	assert.Equal(t, errors, output["errors"])
+	assert.NotEmpty(t, output["sha256"])
+}
+
+func TestChunkedUploadRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write([]byte(`{"upload":"accepted"}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	task := new(mockCatalogTask)
+	twriter, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: ts.URL}, map[string]string{"task_url": "taskURL"})
+	shareWriteOperation(t, twriter)
+
+	output := map[string]interface{}{
+		"ingress":        map[string]interface{}{"upload": "accepted"},
+		"sha256":         "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1",
+		"tar_size":       int64(414),
+		"content_sha256": "464acd3009606a354529fb4c5ac11b25dace97c07fdf4f9531847785f02d00e1",
+	}
+	shareFlushTest(t, twriter.(*tarWriter), &output, "ok", "", "Catalog Worker Completed Successfully")
+}
+
+func TestUploadMetadata(t *testing.T) {
+	jobs := []common.JobParam{{Method: "GET", HrefSlug: "/api/v2/job_templates/"}}
+	var md upload.Metadata
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if assert.NoError(t, err) {
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					break
+				}
+				if part.FormName() == "metadata" {
+					assert.NoError(t, json.NewDecoder(part).Decode(&md))
+				}
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, err = w.Write([]byte(`{"upload":"accepted"}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	task := new(mockCatalogTask)
+	metadata := map[string]string{"task_url": "taskURL", "worker_version": "1.0", "tower_uuid": "8ed2ad0c", "tower_name": "tower.example.com"}
+	twriter, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: ts.URL, Jobs: jobs}, metadata)
+	shareWriteOperation(t, twriter)
+
+	output := map[string]interface{}{
+		"ingress":        map[string]interface{}{"upload": "accepted"},
+		"sha256":         "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1",
+		"tar_size":       int64(414),
+		"content_sha256": "464acd3009606a354529fb4c5ac11b25dace97c07fdf4f9531847785f02d00e1",
+	}
+	shareFlushTest(t, twriter.(*tarWriter), &output, "ok", "", "Catalog Worker Completed Successfully")
+	assert.Equal(t, upload.Metadata{
+		TaskURL:       "taskURL",
+		WorkerVersion: "1.0",
+		TowerUUID:     "8ed2ad0c",
+		TowerName:     "tower.example.com",
+		SHA256:        "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1",
+		Size:          414,
+		Jobs:          jobs,
+	}, md)
+}
+
+func TestResumableUnsupported(t *testing.T) {
+	viper.Set("worker.upload.resumable", true)
+	defer viper.Set("worker.upload.resumable", nil)
+	var methods []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		assert.True(t, r.ContentLength > 0, "The buffered tar file is sent with its content length")
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write([]byte(`{"upload":"accepted"}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	task := new(mockCatalogTask)
+	twriter, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: ts.URL}, map[string]string{"task_url": "taskURL"})
+	shareWriteOperation(t, twriter)
+
+	output := map[string]interface{}{
+		"ingress":        map[string]interface{}{"upload": "accepted"},
+		"sha256":         "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1",
+		"tar_size":       int64(414),
+		"content_sha256": "464acd3009606a354529fb4c5ac11b25dace97c07fdf4f9531847785f02d00e1",
+	}
+	shareFlushTest(t, twriter.(*tarWriter), &output, "ok", "", "Catalog Worker Completed Successfully")
+	assert.Equal(t, []string{http.MethodOptions, http.MethodPost}, methods)
+}
+
 func TestNoUpload(t *testing.T) {
 	task := new(mockCatalogTask)
-	input := common.RequestInput{PreviousSHA: "8d97f6ddad8fb21b41a2d97079fbb371e590fc5c4afb9556faa9de1ba025d84c", PreviousSize: int64(134)}
+	input := common.RequestInput{PreviousSHA: "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1", PreviousSize: int64(414)}
+	writer, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, map[string]string{"task_url": "taskURL"})
+	shareWriteOperation(t, writer)
+
+	shareFlushTest(t, writer.(*tarWriter), nil, "unchanged", "", "Upload skipped since nothing has changed from last refresh")
+}
+
+func TestNoUploadContentSHA(t *testing.T) {
+	task := new(mockCatalogTask)
+	input := common.RequestInput{PreviousContentSHA: "464acd3009606a354529fb4c5ac11b25dace97c07fdf4f9531847785f02d00e1", PreviousSHA: "outdated"}
 	writer, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, input, map[string]string{"task_url": "taskURL"})
 	shareWriteOperation(t, writer)
 
 	shareFlushTest(t, writer.(*tarWriter), nil, "unchanged", "", "Upload skipped since nothing has changed from last refresh")
 }
 
+func TestManifest(t *testing.T) {
+	twriter, _ := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), new(mockCatalogTask), common.RequestInput{}, nil)
+	writerObj := twriter.(*tarWriter)
+	assert.NoError(t, writerObj.Write("/api/v2/b/page1.json", []byte("b")))
+	assert.NoError(t, writerObj.Write("/api/v2/a/page1.json", []byte("a")))
+	first, err := writerObj.contentSHA()
+	assert.NoError(t, err)
+
+	b, err := writerObj.manifest()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"files":[`+
+		`{"name":"/api/v2/a/page1.json","sha256":"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb","size":1},`+
+		`{"name":"/api/v2/b/page1.json","sha256":"3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d","size":1}]}`, string(b))
+
+	// rewriting a page with different content changes the content sha
+	assert.NoError(t, writerObj.Write("/api/v2/a/page1.json", []byte("c")))
+	second, err := writerObj.contentSHA()
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
+
 func TestUploadFailed(t *testing.T) {
 	ts, writerObj := shareWriteTest(t, http.StatusNotFound, "")
 	defer ts.Close()
 
-	shareFlushTest(t, writerObj, &map[string]interface{}{"errors": []string{"Failed to upload the tar file"}}, "error", "Upload failed", "Catalog Worker Ended with errors")
+	errors := []common.JobError{{Href: ts.URL, Method: "upload", Message: "Failed to upload the tar file", Retryable: true}}
+	shareFlushTest(t, writerObj, &map[string]interface{}{"errors": errors}, "error", "Upload failed", "Catalog Worker Ended with errors")
+}
+
+func useTestOutbox(t *testing.T) *outbox.Outbox {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	o, err := outbox.Open(dir, time.Hour, 1024*1024, retry.Policy{})
+	assert.NoError(t, err)
+	UseOutbox(o)
+	t.Cleanup(func() {
+		UseOutbox(nil)
+		os.RemoveAll(dir)
+	})
+	return o
+}
+
+func TestUploadQueued(t *testing.T) {
+	o := useTestOutbox(t)
+	ts, writerObj := shareWriteTest(t, http.StatusServiceUnavailable, "Unavailable")
+	defer ts.Close()
+
+	task := writerObj.task.(*mockCatalogTask)
+	task.On("Update", map[string]interface{}{
+		"state":   "running",
+		"status":  "pending_upload",
+		"message": "Upload failed, the tar file is queued to be uploaded again",
+		"output": &map[string]interface{}{
+			"sha256":         "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1",
+			"tar_size":       int64(414),
+			"content_sha256": "464acd3009606a354529fb4c5ac11b25dace97c07fdf4f9531847785f02d00e1",
+		},
+	}).Return(nil)
+	assert.NoError(t, writerObj.Flush())
+	task.AssertExpectations(t)
+
+	pending := o.Pending()
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, "taskURL", pending[0].TaskURL)
+		assert.Equal(t, ts.URL, pending[0].UploadURL)
+		assert.Equal(t, int64(414), pending[0].Size)
+		assert.Equal(t, "ok", pending[0].Status)
+		assert.Equal(t, "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1", pending[0].Output["sha256"])
+		if assert.NotNil(t, pending[0].Metadata) {
+			assert.Equal(t, "e6a98f7dbdbba287acaee16d657ba301ba4fb9b0b90aa5d76afbe37798f111d1", pending[0].Metadata.SHA256)
+			assert.Equal(t, int64(414), pending[0].Metadata.Size)
+		}
+	}
+}
+
+func TestUploadFailedNotQueued(t *testing.T) {
+	o := useTestOutbox(t)
+	ts, writerObj := shareWriteTest(t, http.StatusNotFound, "")
+	defer ts.Close()
+
+	errors := []common.JobError{{Href: ts.URL, Method: "upload", Message: "Failed to upload the tar file", Retryable: true}}
+	shareFlushTest(t, writerObj, &map[string]interface{}{"errors": errors}, "error", "Upload failed", "Catalog Worker Ended with errors")
+	assert.Empty(t, o.Pending(), "Only transient failures are queued")
 }
 
 func TestUnmarshalFailed(t *testing.T) {
 	ts, writerObj := shareWriteTest(t, http.StatusAccepted, `bad{"upload":"accepted"}`)
 	defer ts.Close()
 
-	shareFlushTest(t, writerObj, &map[string]interface{}{"errors": []string{"Failed to unmarshal the body of uploading API call"}}, "error", "invalid character", "Catalog Worker Ended with errors")
+	errors := []common.JobError{{Href: ts.URL, Method: "upload", Message: "Failed to unmarshal the body of uploading API call"}}
+	shareFlushTest(t, writerObj, &map[string]interface{}{"errors": errors}, "error", "invalid character", "Catalog Worker Ended with errors")
 }
 
 func TestFlushError(t *testing.T) {
 	task := new(mockCatalogTask)
-	task.On("Update", map[string]interface{}{"state": "completed", "status": "error", "output": &map[string]interface{}{"errors": []string{"error 1", "error 2"}}, "message": "Catalog Worker Ended with errors"}).Return(nil)
+	errors := []common.JobError{{Href: "/api/v2/job_templates", Message: "error 1"}, {Href: "/api/v2/inventories", Message: "error 2"}}
+	task.On("Update", map[string]interface{}{"state": "completed", "status": "error", "output": &map[string]interface{}{"errors": errors}, "message": "Catalog Worker Ended with errors"}).Return(nil)
+	twriter, err := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: "uploadURL"}, map[string]string{"task_url": "taskURL"})
+	assert.NoError(t, err)
+	err = twriter.FlushErrors(errors)
+
+	task.AssertExpectations(t)
+	assert.NoError(t, err)
+}
+
+func TestAbort(t *testing.T) {
+	task := new(mockCatalogTask)
+	errors := []common.JobError{{Href: "/api/v2/job_templates", Message: "error 1"}}
+	task.On("Update", map[string]interface{}{"state": "completed", "status": "timedout", "output": &map[string]interface{}{"errors": errors}, "message": "Catalog Worker timed out after 10 minutes"}).Return(nil)
 	twriter, err := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), task, common.RequestInput{UploadURL: "uploadURL"}, map[string]string{"task_url": "taskURL"})
 	assert.NoError(t, err)
-	err = twriter.FlushErrors([]string{"error 1", "error 2"})
+	shareWriteOperation(t, twriter)
+	err = twriter.Abort("timedout", "Catalog Worker timed out after 10 minutes", errors)
 
 	task.AssertExpectations(t)
 	assert.NoError(t, err)
+	assert.Empty(t, twriter.(*tarWriter).pages)
+	assert.Zero(t, twriter.(*tarWriter).entries.Len())
+}
+
+func TestStagedPagesMatchMemory(t *testing.T) {
+	pages := map[string]string{
+		"/api/v2/job_templates/page1.json":               strings.Repeat("jt", 300),
+		"/api/v2/job_templates/page2.json":               strings.Repeat("tj", 300),
+		"/api/v2/job_templates/7/survey_spec/page1.json": `{"name":"survey"}`,
+		"/api/v2/inventories/page1.json":                 strings.Repeat("in", 300),
+	}
+	archive := func(memoryLimit int64) (string, int64, bool) {
+		twriter, err := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), new(mockCatalogTask), common.RequestInput{}, nil)
+		assert.NoError(t, err)
+		writerObj := twriter.(*tarWriter)
+		writerObj.entries.limit = memoryLimit
+		defer writerObj.cleanup()
+		for name, data := range pages {
+			assert.NoError(t, writerObj.Write(name, []byte(data)))
+		}
+		out := &spillBuffer{limit: memoryLimit}
+		defer out.Close()
+		sha, size, err := writerObj.writeArchive(out)
+		assert.NoError(t, err)
+		return sha, size, writerObj.entries.spilled()
+	}
+
+	memSHA, memSize, memStaged := archive(1024 * 1024)
+	diskSHA, diskSize, diskStaged := archive(200)
+	assert.False(t, memStaged, "Pages should be kept in memory")
+	assert.True(t, diskStaged, "Compressed pages should be staged on disk")
+	assert.Equal(t, memSHA, diskSHA)
+	assert.Equal(t, memSize, diskSize)
+}
+
+func TestArchiveContents(t *testing.T) {
+	twriter, err := MakeTarWriter(logger.CtxWithLoggerID(context.Background(), "123"), new(mockCatalogTask), common.RequestInput{}, nil)
+	assert.NoError(t, err)
+	writerObj := twriter.(*tarWriter)
+	defer writerObj.cleanup()
+	assert.NoError(t, writerObj.Write("/api/v2/inventories/page1.json", []byte("old")))
+	assert.NoError(t, writerObj.Write("/api/v2/hosts/page1.json", []byte("hosts")))
+	assert.NoError(t, writerObj.Write("/api/v2/inventories/page1.json", []byte("new")))
+
+	var buf bytes.Buffer
+	sha, size, err := writerObj.writeArchive(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), size)
+	sum := sha256.Sum256(buf.Bytes())
+	assert.Equal(t, hex.EncodeToString(sum[:]), sha)
+
+	zr, err := gzip.NewReader(&buf)
+	assert.NoError(t, err)
+	tr := tar.NewReader(zr)
+	var names []string
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		b, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		names = append(names, hdr.Name)
+		contents[hdr.Name] = string(b)
+	}
+	assert.Equal(t, []string{"./", "/api", "/api/v2", "/api/v2/hosts", "/api/v2/hosts/page1.json",
+		"/api/v2/inventories", "/api/v2/inventories/page1.json", "/manifest.json"}, names)
+	assert.Equal(t, "new", contents["/api/v2/inventories/page1.json"], "The page written last is archived")
+	manifest, err := writerObj.manifest()
+	assert.NoError(t, err)
+	assert.Equal(t, string(manifest), contents["/manifest.json"])
+}
+
+func TestSpillBuffer(t *testing.T) {
+	sb := &spillBuffer{limit: 8}
+	_, err := sb.Write([]byte("12345"))
+	assert.NoError(t, err)
+	assert.False(t, sb.spilled())
+	_, err = sb.Write([]byte("6789"))
+	assert.NoError(t, err)
+	assert.True(t, sb.spilled())
+	name := sb.file.Name()
+
+	assert.Equal(t, int64(9), sb.Len())
+	b, err := ioutil.ReadAll(io.NewSectionReader(sb.ReaderAt(), 0, sb.Len()))
+	assert.NoError(t, err)
+	assert.Equal(t, "123456789", string(b))
+
+	assert.NoError(t, sb.Close())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
 }
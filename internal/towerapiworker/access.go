@@ -0,0 +1,64 @@
+package towerapiworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/accesspolicy"
+)
+
+// checkAccess rejects the job unless the access policy of the task allows it
+func (w *workUnit) checkAccess() error {
+	err := w.allowed(w.input.Method, w.parsedURL.Path)
+	if err != nil {
+		w.glog.Errorf("Job %s %s rejected %v", w.input.Method, w.input.HrefSlug, err)
+		w.sendError(err.Error(), 0)
+	}
+	return err
+}
+
+// allowed asks the access policy of the task if the method is allowed on the path
+func (w *workUnit) allowed(method string, urlPath string) error {
+	return accesspolicy.FromContext(w.ctx).Check(method, urlPath, w.launchedTemplate)
+}
+
+// launchedTemplate reads the labels and the organization of the template launched by the job
+func (w *workUnit) launchedTemplate() (accesspolicy.Template, error) {
+	tw := &workUnit{ctx: w.ctx, glog: w.glog, config: w.config, hostURL: w.hostURL, client: w.client}
+	tw.parsedURL = w.hostURL.ResolveReference(&url.URL{Path: strings.TrimSuffix(strings.TrimSuffix(w.parsedURL.Path, "/"), "/launch") + "/"})
+	body, resp, err := tw.doRequest(http.MethodGet, nil)
+	if err != nil {
+		return accesspolicy.Template{}, err
+	}
+	if !successHTTPCode(resp.StatusCode) {
+		return accesspolicy.Template{}, fmt.Errorf("Invalid HTTP Status code from %s, status: %d", tw.parsedURL.String(), resp.StatusCode)
+	}
+	var jt struct {
+		Organization  json.Number `json:"organization"`
+		SummaryFields struct {
+			Organization struct {
+				Name string `json:"name"`
+			} `json:"organization"`
+			Labels struct {
+				Results []struct {
+					Name string `json:"name"`
+				} `json:"results"`
+			} `json:"labels"`
+		} `json:"summary_fields"`
+	}
+	if err := json.Unmarshal(body, &jt); err != nil {
+		return accesspolicy.Template{}, err
+	}
+	t := accesspolicy.Template{Organization: jt.SummaryFields.Organization.Name}
+	if id, err := jt.Organization.Int64(); err == nil {
+		t.OrganizationID = strconv.FormatInt(id, 10)
+	}
+	for _, l := range jt.SummaryFields.Labels.Results {
+		t.Labels = append(t.Labels, l.Name)
+	}
+	return t, nil
+}
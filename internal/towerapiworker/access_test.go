@@ -0,0 +1,113 @@
+package towerapiworker
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/accesspolicy"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+)
+
+const templateBody = `{"id": 5, "type": "job_template", "organization": 3, "summary_fields": {"organization": {"id": 3, "name": "Default"}, "labels": {"count": 2, "results": [{"id": 1, "name": "inventory"}, {"id": 2, "name": "nightly"}]}}}`
+
+func launchPolicy() *accesspolicy.Policy {
+	return &accesspolicy.Policy{Rules: []accesspolicy.Rule{
+		{Methods: []string{"post"}, Paths: []string{"/api/v2/job_templates/*/launch/"}},
+		{Methods: []string{"launch"}, Paths: []string{"/api/v2/job_templates/*/launch/"}, Labels: []string{"cloud"}},
+	}}
+}
+
+func TestAccessAllowed(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"name": "job1", "id": 1}`}
+	responses := []map[string]interface{}{{"name": "job1", "id": float64(1)}}
+	jp := common.JobParam{Method: "post", HrefSlug: "/api/v2/job_templates/5/launch"}
+
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ts.context = accesspolicy.WithPolicy(ts.context, launchPolicy())
+	ts.runSuccessWith(t, jp, responses)
+}
+
+func TestAccessRejected(t *testing.T) {
+	t.Parallel()
+	errors := []string{"URL: /api/v2/inventories Status: 0 Message: Rejected by the access policy, get of /api/v2/inventories is not allowed"}
+	jp := common.JobParam{Method: "get", HrefSlug: "/api/v2/inventories"}
+
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, []string{})
+	ts.context = accesspolicy.WithPolicy(ts.context, launchPolicy())
+	ts.runFailWith(t, jp, errors)
+	assert.Empty(t, ts.client.Transport.(*fakeTransport).requests, "Nothing is sent to Tower")
+}
+
+func TestAccessLaunchRejected(t *testing.T) {
+	t.Parallel()
+	errors := []string{"URL: /api/v2/job_templates/5/launch/ Status: 0 Message: Rejected by the access policy, the template of /api/v2/job_templates/5/launch/ has no allowed label or organization"}
+	jp := common.JobParam{Method: "launch", HrefSlug: "/api/v2/job_templates/5/launch/"}
+
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, []string{templateBody})
+	ts.context = accesspolicy.WithPolicy(ts.context, launchPolicy())
+	ts.runFailWith(t, jp, errors)
+	assert.Equal(t, []string{"GET /api/v2/job_templates/5/"}, ts.client.Transport.(*fakeTransport).requests, "The template is read but not launched")
+}
+
+func TestAccessPostLaunchRejected(t *testing.T) {
+	t.Parallel()
+	errors := []string{"URL: /api/v2/job_templates/5/launch/ Status: 0 Message: Rejected by the access policy, the template of /api/v2/job_templates/5/launch/ has no allowed label or organization"}
+	jp := common.JobParam{Method: "post", HrefSlug: "/api/v2/job_templates/5/launch/"}
+
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, []string{templateBody})
+	ts.context = accesspolicy.WithPolicy(ts.context, &accesspolicy.Policy{Rules: []accesspolicy.Rule{
+		{Methods: []string{"post"}, Paths: []string{"/api/v2/job_templates/*/launch/"}, Labels: []string{"cloud"}},
+	}})
+	ts.runFailWith(t, jp, errors)
+	assert.Equal(t, []string{"GET /api/v2/job_templates/5/"}, ts.client.Transport.(*fakeTransport).requests, "The template is read but not launched")
+}
+
+func TestLaunchedTemplate(t *testing.T) {
+	ts := &testScaffold{}
+	ts.base(t, common.JobParam{}, 200, []string{templateBody})
+	w := &workUnit{ctx: ts.context, glog: logger.GetLogger(ts.context), client: ts.client, input: &common.JobParam{Method: "launch"}}
+	assert.NoError(t, w.setConfig(ts.config))
+	w.parsedURL = w.hostURL.ResolveReference(&url.URL{Path: "/api/v2/job_templates/5/launch/"})
+
+	template, err := w.launchedTemplate()
+	assert.NoError(t, err)
+	assert.Equal(t, accesspolicy.Template{Labels: []string{"inventory", "nightly"}, Organization: "Default", OrganizationID: "3"}, template)
+}
+
+func TestAccessCancelJob(t *testing.T) {
+	t.Parallel()
+	monitor := accesspolicy.Rule{Methods: []string{"monitor"}, Paths: []string{"/api/v2/jobs/*/"}}
+	cancelJob := accesspolicy.Rule{Methods: []string{"post"}, Paths: []string{"/api/v2/jobs/*/cancel/"}}
+	for _, tc := range []struct {
+		rules    []accesspolicy.Rule
+		requests []string
+	}{
+		{[]accesspolicy.Rule{monitor}, []string{"GET /api/v2/jobs/15"}},
+		{[]accesspolicy.Rule{monitor, cancelJob}, []string{"GET /api/v2/jobs/15", "POST /api/v2/jobs/15/cancel/"}},
+	} {
+		jp := common.JobParam{Method: "monitor", HrefSlug: jobs15, RefreshIntervalSeconds: 10}
+		ts := &testScaffold{}
+		ts.base(t, jp, 202, []string{`{"name": "job15", "id": 15, "url": "url15", "status":"running"}`, `{}`})
+		ctx, markCancelJobs := WithJobCancellation(accesspolicy.WithPolicy(ts.context, &accesspolicy.Policy{Rules: tc.rules}))
+		ctx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(50*time.Millisecond, func() {
+			markCancelJobs()
+			cancel()
+		})
+
+		apiw := &DefaultAPIWorker{}
+		err := apiw.StartWork(ctx, ts.config, jp, ts.client, ts.channels)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, tc.requests, ts.client.Transport.(*fakeTransport).requests, "The cancel is a post the policy must allow")
+	}
+}
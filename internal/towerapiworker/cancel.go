@@ -0,0 +1,57 @@
+package towerapiworker
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cancelJobTimeout bounds the cancel call, the ctx of the task is already cancelled when it is sent
+const cancelJobTimeout = 30 * time.Second
+
+type cancelJobsKey struct{}
+
+// WithJobCancellation returns a ctx for the workers of a task and a function that marks it.
+// When the ctx is cancelled after it was marked the monitored Tower jobs are cancelled in Tower too.
+func WithJobCancellation(ctx context.Context) (context.Context, func()) {
+	marked := new(int32)
+	return context.WithValue(ctx, cancelJobsKey{}, marked), func() { atomic.StoreInt32(marked, 1) }
+}
+
+func cancelJobsRequested(ctx context.Context) bool {
+	marked, ok := ctx.Value(cancelJobsKey{}).(*int32)
+	return ok && atomic.LoadInt32(marked) == 1
+}
+
+// cancelJob asks Tower to cancel the monitored job, if the access policy allows the post
+func (w *workUnit) cancelJob() {
+	u := *w.parsedURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/cancel/"
+	u.RawQuery = ""
+	if err := w.allowed("post", u.Path); err != nil {
+		w.glog.Errorf("Tower job %s not cancelled %v", u.String(), err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cancelJobTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		w.glog.Errorf("Error building the cancel request %v", err)
+		return
+	}
+	req.Header.Add("Authorization", "Bearer "+w.config.Token)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		w.glog.Errorf("Error cancelling the Tower job %s %v", u.String(), err)
+		return
+	}
+	resp.Body.Close()
+	if !successHTTPCode(resp.StatusCode) {
+		// Tower answers 405 if the job can no longer be cancelled
+		w.glog.Errorf("Tower job %s not cancelled, Status %s", u.String(), resp.Status)
+		return
+	}
+	w.glog.Infof("Tower job %s cancelled", u.String())
+}
@@ -0,0 +1,44 @@
+package towerapiworker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+)
+
+// TowerIdentity identifies the Ansible Tower the inventory is collected from
+type TowerIdentity struct {
+	UUID    string // The install uuid of Ansible Tower
+	Name    string // The host name of the Ansible Tower URL
+	Version string
+}
+
+// FetchTowerIdentity reads the install uuid and the version of Ansible Tower from its ping endpoint
+func FetchTowerIdentity(ctx context.Context, config *common.CatalogConfig, client *http.Client) (TowerIdentity, error) {
+	w := &workUnit{ctx: ctx, glog: logger.GetLogger(ctx)}
+	if err := w.setConfig(config); err != nil {
+		return TowerIdentity{}, err
+	}
+	w.setClient(client)
+	w.parsedURL = w.hostURL.ResolveReference(&url.URL{Path: "/api/v2/ping/"})
+	body, resp, err := w.doRequest(http.MethodGet, nil)
+	if err != nil {
+		return TowerIdentity{}, err
+	}
+	if !successHTTPCode(resp.StatusCode) {
+		return TowerIdentity{}, fmt.Errorf("Invalid HTTP Status code from %s, status: %d", w.parsedURL.String(), resp.StatusCode)
+	}
+	var ping struct {
+		InstallUUID string `json:"install_uuid"`
+		Version     string `json:"version"`
+	}
+	if err := json.Unmarshal(body, &ping); err != nil {
+		return TowerIdentity{}, err
+	}
+	return TowerIdentity{UUID: ping.InstallUUID, Name: w.hostURL.Hostname(), Version: ping.Version}, nil
+}
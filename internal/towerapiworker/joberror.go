@@ -0,0 +1,68 @@
+package towerapiworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+)
+
+// maxMessageLength limits the size of a message in the task output, Tower
+// might respond with a complete HTML error page
+const maxMessageLength = 1024
+
+// jobError creates the error record of the job
+func (w *workUnit) jobError(message string, httpStatus int) common.JobError {
+	return common.JobError{
+		Href:       w.input.HrefSlug,
+		Method:     strings.ToLower(w.input.Method),
+		HTTPStatus: httpStatus,
+		Message:    truncate(message),
+		Timestamp:  time.Now().UTC(),
+	}
+}
+
+// truncate shortens a message to maxMessageLength bytes without splitting a character
+func truncate(s string) string {
+	if len(s) <= maxMessageLength {
+		return s
+	}
+	short := strings.ToValidUTF8(s[:maxMessageLength], "")
+	return fmt.Sprintf("%s... (%d bytes truncated)", short, len(s)-len(short))
+}
+
+// towerDetail extracts the error detail from a Tower JSON error response. Tower reports
+// most errors in detail or error and validation errors as a list of messages per field.
+func towerDetail(body []byte) string {
+	var m map[string]interface{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return ""
+	}
+	for _, key := range []string{"detail", "error", "msg"} {
+		if s, ok := m[key].(string); ok {
+			return truncate(s)
+		}
+	}
+
+	var fields []string
+	for key, v := range m {
+		messages, ok := v.([]interface{})
+		if !ok {
+			continue
+		}
+		var texts []string
+		for _, msg := range messages {
+			if s, ok := msg.(string); ok {
+				texts = append(texts, s)
+			}
+		}
+		if len(texts) > 0 {
+			fields = append(fields, key+": "+strings.Join(texts, " "))
+		}
+	}
+	sort.Strings(fields)
+	return truncate(strings.Join(fields, "; "))
+}
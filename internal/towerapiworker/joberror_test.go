@@ -0,0 +1,26 @@
+package towerapiworker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short"))
+
+	long := "<html>" + strings.Repeat("é", maxMessageLength) + "</html>"
+	s := truncate(long)
+	assert.True(t, strings.HasPrefix(s, "<html>éé"))
+	assert.True(t, strings.HasSuffix(s, "... (1037 bytes truncated)"), "Cut after 509 two byte characters")
+	assert.True(t, len(s) < maxMessageLength+40)
+}
+
+func TestTowerDetail(t *testing.T) {
+	assert.Equal(t, "Not found.", towerDetail([]byte(`{"detail": "Not found."}`)))
+	assert.Equal(t, "Job template is not launchable", towerDetail([]byte(`{"error": "Job template is not launchable"}`)))
+	assert.Equal(t, "inventory: This field is required.; limit: Ensure this field has no more than 1024 characters.",
+		towerDetail([]byte(`{"limit": ["Ensure this field has no more than 1024 characters."], "inventory": ["This field is required."]}`)))
+	assert.Equal(t, "", towerDetail([]byte("<html><body>Bad Gateway</body></html>")))
+}
@@ -19,14 +19,21 @@ import (
 type fakeTransport struct {
 	body          []string
 	status        int
+	statuses      []int
 	requestNumber int
+	requests      []string // method and path of every request
 	T             *testing.T
 }
 
 func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := f.status
+	if f.statuses != nil {
+		status = f.statuses[f.requestNumber]
+	}
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
 	resp := &http.Response{
-		StatusCode: f.status,
-		Status:     http.StatusText(f.status),
+		StatusCode: status,
+		Status:     http.StatusText(status),
 		Body:       ioutil.NopCloser(bytes.NewBufferString(f.body[f.requestNumber])),
 		Header: http.Header{
 			"Content-Type": {"application/json"},
@@ -42,10 +49,17 @@ func fakeClient(t *testing.T, body []string, status int) *http.Client {
 	}
 }
 
+func fakeClientWithStatuses(t *testing.T, body []string, statuses []int) *http.Client {
+	return &http.Client{
+		Transport: &fakeTransport{body: body, statuses: statuses, T: t},
+	}
+}
+
 type testScaffold struct {
 	t                    *testing.T
 	receivedResponses    [][]byte
 	receivedErrors       []string
+	receivedJobErrors    []common.JobError
 	responseBody         []string
 	expectedResponses    []map[string]interface{}
 	expectedErrors       []string
@@ -87,7 +101,8 @@ func (ts *testScaffold) startErrorListener() {
 			done = true
 			break
 		case errMsg := <-ts.channels.ErrorChannel:
-			ts.receivedErrors = append(ts.receivedErrors, errMsg)
+			ts.receivedErrors = append(ts.receivedErrors, errMsg.Error())
+			ts.receivedJobErrors = append(ts.receivedJobErrors, errMsg)
 			ts.numErrors++
 			if ts.numErrors == len(ts.expectedErrors) {
 				ts.terminateMain <- true
@@ -111,6 +126,10 @@ func (ts *testScaffold) base(t *testing.T, jp common.JobParam, responseCode int,
 
 func (ts *testScaffold) runSuccess(t *testing.T, jp common.JobParam, responseCode int, responseBody []string, responses []map[string]interface{}) {
 	ts.base(t, jp, responseCode, responseBody)
+	ts.runSuccessWith(t, jp, responses)
+}
+
+func (ts *testScaffold) runSuccessWith(t *testing.T, jp common.JobParam, responses []map[string]interface{}) {
 	ts.channels.ResponseChannel = make(chan common.Page)
 	defer close(ts.channels.ResponseChannel)
 	ts.expectedResponses = responses
@@ -134,9 +153,20 @@ func (ts *testScaffold) runSuccess(t *testing.T, jp common.JobParam, responseCod
 
 func (ts *testScaffold) runFail(t *testing.T, jp common.JobParam, responseCode int, responseBody []string, errorMessages []string) {
 	ts.base(t, jp, responseCode, responseBody)
-	ts.channels.ErrorChannel = make(chan string)
+	ts.runFailWith(t, jp, errorMessages)
+}
+
+func (ts *testScaffold) runFailWith(t *testing.T, jp common.JobParam, errorMessages []string) {
+	ts.channels.ErrorChannel = make(chan common.JobError)
 	defer close(ts.channels.ErrorChannel)
 	ts.expectedErrors = errorMessages
+	// Pages written before the failure are not checked
+	ts.channels.ResponseChannel = make(chan common.Page)
+	defer close(ts.channels.ResponseChannel)
+	go func() {
+		for range ts.channels.ResponseChannel {
+		}
+	}()
 
 	go ts.startErrorListener()
 
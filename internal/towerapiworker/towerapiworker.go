@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -17,19 +18,25 @@ import (
 	"time"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/artifacts"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/canonical"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/filters"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/governance"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
 )
 
+// lateErrorWait bounds how long a cancelled worker waits to hand over the errors it must report
+const lateErrorWait = 5 * time.Second
+
 // WorkChannels collects all channels for communication between the api worker and client request goroutines
 type WorkChannels struct {
-	Shutdown        chan struct{}
-	ErrorChannel    chan string
-	DispatchChannel chan common.JobParam
-	FinishedChannel chan bool
-	WaitChannel     chan bool
-	ResponseChannel chan common.Page
+	ErrorChannel        chan common.JobError
+	PartialErrorChannel chan common.JobError // Errors of the jobs that continue on error
+	DispatchChannel     chan common.JobParam
+	FinishedChannel     chan bool
+	WaitChannel         chan bool // True once all jobs finished, false if they were stopped by the cancelled ctx
+	ResponseChannel     chan common.Page
 }
 
 type relatedObject struct {
@@ -48,34 +55,43 @@ type DefaultAPIWorker struct {
 }
 
 // StartWork can be started as a go routine to start a unit of work based on a given JobParam
-// The responses are sent to the Responder's channel so that it can relay it to the Receptor
+// The responses are sent to the Responder's channel so that it can relay it to the Receptor.
+// Cancelling the ctx aborts the in-flight calls to Ansible Tower.
 func (aw *DefaultAPIWorker) StartWork(ctx context.Context, config *common.CatalogConfig, params common.JobParam, client *http.Client, wc WorkChannels) error {
 	glog := logger.GetLogger(ctx)
 	glog.Info("Worker starting")
 	w := &workUnit{}
+	w.ctx = ctx
 	w.glog = glog
 	err := w.setConfig(config)
 	if err != nil {
 		glog.Errorf("Error setting config  %v", err)
 		return err
 	}
-	w.setJobParameters(params)
 	w.errorChannel = wc.ErrorChannel
-	w.shutdown = wc.Shutdown
 	w.dispatchChannel = wc.DispatchChannel
 	w.responseChannel = wc.ResponseChannel
+	err = w.setJobParameters(params)
+	if err != nil {
+		glog.Errorf("Error setting job parameters %v", err)
+		return err
+	}
 	err = w.setURL()
 	if err != nil {
 		glog.Errorf("Error setting up URL %v", err)
 		return err
 	}
 	w.setClient(client)
+	if err := w.checkAccess(); err != nil {
+		return err
+	}
 	w.glog.Info("Dispatch started")
 	return w.dispatch()
 }
 
 // workUnit is a data struct to store a single unit of work
 type workUnit struct {
+	ctx             context.Context
 	glog            logger.Logger
 	config          *common.CatalogConfig
 	hostURL         *url.URL
@@ -84,10 +100,9 @@ type workUnit struct {
 	filterValue     *filters.Value
 	parsedURL       *url.URL
 	parsedValues    url.Values
-	errorChannel    chan string
+	errorChannel    chan common.JobError
 	dispatchChannel chan common.JobParam
 	responseChannel chan common.Page
-	shutdown        chan struct{}
 	relatedObjects  []relatedObject
 }
 
@@ -96,7 +111,7 @@ func (w *workUnit) setConfig(p *common.CatalogConfig) error {
 	return w.parseHost(p.URL)
 }
 
-func (w *workUnit) setJobParameters(data common.JobParam) {
+func (w *workUnit) setJobParameters(data common.JobParam) error {
 	if data.ApplyFilter != nil {
 		fltr := filters.Value{}
 		fltr.Parse(data.ApplyFilter)
@@ -109,28 +124,29 @@ func (w *workUnit) setJobParameters(data common.JobParam) {
 		data.PagePrefix = "page"
 	}
 
-	w.setRelatedObjects(data)
 	w.input = &data
+	return w.setRelatedObjects(data)
 }
 
-func (w *workUnit) setRelatedObjects(data common.JobParam) {
-	if data.FetchRelated != nil {
-		for _, o := range data.FetchRelated {
-			obj := o.(map[string]interface{})
-			w.setRelated(obj)
+func (w *workUnit) setRelatedObjects(data common.JobParam) error {
+	for i, o := range data.FetchRelated {
+		obj, ok := o.(map[string]interface{})
+		if !ok {
+			return w.fieldError(fmt.Sprintf("fetch_related[%d]", i), o)
 		}
+		w.setRelated(obj)
 	}
+	return nil
 }
 
 func (w *workUnit) setClient(c *http.Client) {
 	w.glog.Infof("Setting client %v", c)
 	if c == nil {
-		var tr *http.Transport
+		w.client = &http.Client{}
 		if w.config.SkipVerifyCertificate {
 			config := &tls.Config{InsecureSkipVerify: true}
-			tr = &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment}
+			w.client.Transport = &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment}
 		}
-		w.client = &http.Client{Transport: tr}
 	} else {
 		w.client = c
 	}
@@ -231,41 +247,130 @@ func (w *workUnit) getPage() ([]byte, int, error) {
 		return nil, 0, err
 	}
 
-	req, err := http.NewRequest("GET", w.parsedURL.String(), nil)
+	return w.sendRequest(http.MethodGet, nil)
+}
+
+// attemptFailure records the outcome of a single failed attempt of an API call
+type attemptFailure struct {
+	status    int
+	message   string
+	body      []byte
+	retryable bool
+	at        time.Time
+}
+
+// sendRequest sends a request to Ansible Tower retrying transient failures based on the
+// retry policy. When all attempts fail, or the job is cancelled while it waits to retry,
+// every failed attempt is reported on the error channel.
+func (w *workUnit) sendRequest(method string, payload []byte) ([]byte, int, error) {
+	maxAttempts := w.config.Retry.Attempts(method)
+	var failures []attemptFailure
+	for attempt := 1; ; attempt++ {
+		if !w.config.RateLimiter.Wait(w.ctx.Done()) {
+			w.reportFailures(failures)
+			return nil, 0, w.ctx.Err()
+		}
+		body, resp, err := w.doRequest(method, payload)
+		if err == nil {
+			w.adaptRate(resp.StatusCode)
+		}
+		if err == nil && successHTTPCode(resp.StatusCode) {
+			return body, resp.StatusCode, nil
+		}
+
+		if w.ctx.Err() != nil {
+			w.glog.Errorf("%s %s aborted %v", method, w.parsedURL.String(), w.ctx.Err())
+			w.reportFailures(failures)
+			return nil, 0, w.ctx.Err()
+		}
+
+		var header http.Header
+		var failure attemptFailure
+		if err != nil {
+			failure = attemptFailure{message: err.Error(), retryable: true, at: time.Now().UTC()}
+		} else {
+			err = errors.New("HTTP " + method + " call failed with " + resp.Status)
+			failure = attemptFailure{status: resp.StatusCode, message: string(body), body: body, retryable: retry.RetryableStatus(resp.StatusCode), at: time.Now().UTC()}
+			header = resp.Header
+		}
+		failures = append(failures, failure)
+		w.glog.Errorf("Attempt %d of %d for %s %s failed %v", attempt, maxAttempts, method, w.parsedURL.String(), err)
+
+		if !failure.retryable || attempt >= maxAttempts {
+			w.reportFailures(failures)
+			return nil, 0, err
+		}
+
+		delay := w.config.Retry.Backoff(attempt, header)
+		w.glog.Infof("Retrying %s %s in %v", method, w.parsedURL.String(), delay)
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			w.reportFailures(failures)
+			return nil, 0, w.ctx.Err()
+		}
+	}
+}
+
+// adaptRate slows down all calls to Tower when it signals it is overloaded
+func (w *workUnit) adaptRate(status int) {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		w.config.RateLimiter.Throttled()
+		w.glog.Infof("Tower is overloaded, request rate lowered to %.2f per second", w.config.RateLimiter.Rate())
+	default:
+		if successHTTPCode(status) {
+			w.config.RateLimiter.Succeeded()
+		}
+	}
+}
+
+func (w *workUnit) doRequest(method string, payload []byte) ([]byte, *http.Response, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewBuffer(payload)
+	}
+	req, err := http.NewRequestWithContext(w.ctx, method, w.parsedURL.String(), reqBody)
 	if err != nil {
 		w.glog.Errorf("Error building New Request %v", err)
-		return nil, 0, err
+		return nil, nil, err
 	}
 	req.Header.Add("Authorization", "Bearer "+w.config.Token)
+	if payload != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
 	resp, err := w.client.Do(req)
 	if err != nil {
 		w.glog.Errorf("Error creating client request %v", err)
-		return nil, 0, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		w.glog.Errorf("Error reading HTTP response %v", err)
-		return nil, 0, err
+		return nil, nil, err
 	}
 
-	w.glog.Info("GET " + w.parsedURL.String() + " Status " + resp.Status)
-
-	err = w.validateHTTPResponse(resp, body)
-	if err != nil {
-		return nil, 0, err
-	}
-	return []byte(body), resp.StatusCode, nil
+	w.glog.Info(method + " " + w.parsedURL.String() + " Status " + resp.Status)
+	return body, resp, nil
 }
 
-func (w *workUnit) validateHTTPResponse(resp *http.Response, body []byte) error {
-	if !successHTTPCode(resp.StatusCode) {
-		err := errors.New("HTTP GET call failed with " + resp.Status)
-		w.sendError(string(body), resp.StatusCode)
-		w.glog.Errorf("%v", err)
-		return err
+// reportFailures sends an error record for every failed attempt of an API call, numbering
+// the messages when the call was retried
+func (w *workUnit) reportFailures(failures []attemptFailure) {
+	for i, f := range failures {
+		message := f.message
+		if len(failures) > 1 {
+			message = fmt.Sprintf("Attempt %d of %d: %s", i+1, len(failures), f.message)
+		}
+		e := w.jobError(message, f.status)
+		e.Detail = towerDetail(f.body)
+		e.Retryable = f.retryable
+		e.Attempt = i + 1
+		e.Attempts = len(failures)
+		e.Timestamp = f.at
+		w.deliverJobError(e)
 	}
-	return nil
 }
 
 func (w *workUnit) post() error {
@@ -275,26 +380,7 @@ func (w *workUnit) post() error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", w.parsedURL.String(), bytes.NewBuffer(b))
-	if err != nil {
-		w.glog.Errorf("Error creating new Post Request %v", err)
-		return err
-	}
-	req.Header.Add("Authorization", "Bearer "+w.config.Token)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := w.client.Do(req)
-	if err != nil {
-		w.glog.Errorf("Error creating HTTP POST request %v", err)
-		return err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		w.glog.Errorf("Error reading POST response %v", err)
-		return err
-	}
-	w.glog.Info("POST " + w.parsedURL.String() + " Status " + resp.Status)
-	err = w.validateHTTPResponse(resp, body)
+	body, _, err := w.sendRequest(http.MethodPost, b)
 	if err != nil {
 		return err
 	}
@@ -306,8 +392,11 @@ func (w *workUnit) post() error {
 	}
 
 	if strings.ToLower(w.input.Method) == "launch" {
-		u := job["url"].(string)
-		w.dispatchChannel <- common.JobParam{Method: "monitor", HrefSlug: u, ApplyFilter: w.input.ApplyFilter}
+		u, ok := job["url"].(string)
+		if !ok {
+			return w.fieldError("url", job["url"])
+		}
+		return w.sendJob(common.JobParam{Method: "monitor", HrefSlug: u, ApplyFilter: w.input.ApplyFilter, ContinueOnError: w.input.ContinueOnError})
 	}
 	return nil
 }
@@ -385,16 +474,33 @@ func (w *workUnit) requestAllRelations(jsonBody map[string]interface{}) error {
 
 func (w *workUnit) requestRelated(jsonBody map[string]interface{}, related relatedObject) error {
 	if val, ok := jsonBody["results"]; ok {
-		for _, o := range val.([]interface{}) {
-			obj := o.(map[string]interface{})
+		results, ok := val.([]interface{})
+		if !ok {
+			return w.fieldError("results", val)
+		}
+		for i, o := range results {
+			obj, ok := o.(map[string]interface{})
+			if !ok {
+				return w.fieldError(fmt.Sprintf("results[%d]", i), o)
+			}
 			if enabled, found := obj[related.predicate]; found {
-				if !enabled.(bool) {
+				b, ok := enabled.(bool)
+				if !ok {
+					return w.fieldError(fmt.Sprintf("results[%d].%s", i, related.predicate), enabled)
+				}
+				if !b {
 					continue
 				}
 			}
 			if rel, found := obj[related.relAttribute]; found {
-				url := rel.(string)
-				w.dispatchChannel <- common.JobParam{Method: "GET", HrefSlug: url, ApplyFilter: related.jobExtra.ApplyFilter}
+				url, ok := rel.(string)
+				if !ok {
+					return w.fieldError(fmt.Sprintf("results[%d].%s", i, related.relAttribute), rel)
+				}
+				err := w.sendJob(common.JobParam{Method: "GET", HrefSlug: url, ApplyFilter: related.jobExtra.ApplyFilter, ContinueOnError: w.input.ContinueOnError})
+				if err != nil {
+					return err
+				}
 			}
 
 		}
@@ -410,6 +516,11 @@ func (w *workUnit) monitor() error {
 	if w.input.RefreshIntervalSeconds == 0 {
 		w.input.RefreshIntervalSeconds = 10
 	}
+	defer func() {
+		if w.ctx.Err() != nil && cancelJobsRequested(w.ctx) {
+			w.cancelJob()
+		}
+	}()
 	for {
 		body, _, err = w.getPage()
 		if err != nil {
@@ -431,7 +542,10 @@ func (w *workUnit) monitor() error {
 			return err
 		}
 
-		status := v.(string)
+		status, ok := v.(string)
+		if !ok {
+			return w.fieldError("status", v)
+		}
 		if !includes(status, allKnownStatus) {
 			err = errors.New("Status " + status + " is not one of the known status")
 			w.sendError(err.Error(), 0)
@@ -441,8 +555,12 @@ func (w *workUnit) monitor() error {
 
 		if includes(status, completedStatus) {
 			break
-		} else {
-			time.Sleep(time.Duration(w.input.RefreshIntervalSeconds) * time.Second)
+		}
+		select {
+		case <-time.After(time.Duration(w.input.RefreshIntervalSeconds) * time.Second):
+		case <-w.ctx.Done():
+			w.glog.Errorf("Monitoring %s aborted %v", w.parsedURL.String(), w.ctx.Err())
+			return w.ctx.Err()
 		}
 	}
 
@@ -455,6 +573,14 @@ func (w *workUnit) monitor() error {
 	return nil
 }
 
+// fieldError reports a field of an unexpected type in the job or the Tower response
+func (w *workUnit) fieldError(field string, value interface{}) error {
+	err := fmt.Errorf("Field %s has an unexpected type %T", field, value)
+	w.glog.Errorf("Error %v", err)
+	w.sendError(err.Error(), 0)
+	return err
+}
+
 func includes(s string, values []string) bool {
 	for _, v := range values {
 		if v == s {
@@ -478,13 +604,18 @@ func (w *workUnit) createJSON(body []byte) (map[string]interface{}, error) {
 		jsonBody, err = w.filterValue.Apply(jsonBody)
 		if err != nil {
 			w.glog.Errorf("Error filtering %v", err)
+			w.sendError(err.Error(), 0)
 			return nil, err
 		}
 	}
 
 	v, ok := jsonBody["artifacts"]
 	if ok && v != nil {
-		s, err := artifacts.Sanctify(v.(map[string]interface{}))
+		a, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, w.fieldError("artifacts", v)
+		}
+		s, err := artifacts.Sanctify(a)
 		if err != nil {
 			w.glog.Errorf("Error sanctifying artifacts %v", err)
 			return nil, err
@@ -494,19 +625,55 @@ func (w *workUnit) createJSON(body []byte) (map[string]interface{}, error) {
 	return jsonBody, nil
 }
 
+// writePage hands over a page after the data policy removed what may not leave the host
 func (w *workUnit) writePage(jsonBody map[string]interface{}, fileName string) error {
-	b, err := json.Marshal(jsonBody)
+	b, err := canonical.Marshal(governance.FromContext(w.ctx).Apply(fileName, jsonBody))
 	if err != nil {
 		w.glog.Errorf("Error marshaling json %v", err)
 		return err
 	}
-	w.responseChannel <- common.Page{Name: fileName, Data: b}
-	return nil
+	select {
+	case w.responseChannel <- common.Page{Name: fileName, Data: b}:
+		return nil
+	case <-w.ctx.Done():
+		w.glog.Errorf("Page %s dropped %v", fileName, w.ctx.Err())
+		return w.ctx.Err()
+	}
+}
+
+// sendJob hands over a new job to the dispatcher
+func (w *workUnit) sendJob(job common.JobParam) error {
+	select {
+	case w.dispatchChannel <- job:
+		return nil
+	case <-w.ctx.Done():
+		w.glog.Errorf("Job %s dropped %v", job.HrefSlug, w.ctx.Err())
+		return w.ctx.Err()
+	}
 }
 
+// sendError reports an error of the job that was not caused by a failed API call
 func (w *workUnit) sendError(message string, httpStatus int) {
-	s := fmt.Sprintf("URL: %s Status: %d Message: %s", w.input.HrefSlug, httpStatus, message)
-	w.errorChannel <- s
+	w.sendJobError(w.jobError(message, httpStatus))
+}
+
+func (w *workUnit) sendJobError(e common.JobError) {
+	select {
+	case w.errorChannel <- e:
+	case <-w.ctx.Done():
+		w.glog.Errorf("Error dropped %v", e)
+	}
+}
+
+// deliverJobError sends an error that must not be dropped when the job is cancelled, like
+// the failed attempts of a call interrupted while it waited to retry. The request keeps
+// receiving errors until the worker finished, the wait only bounds an abandoned worker.
+func (w *workUnit) deliverJobError(e common.JobError) {
+	select {
+	case w.errorChannel <- e:
+	case <-time.After(lateErrorWait):
+		w.glog.Errorf("Error dropped %v", e)
+	}
 }
 
 func successHTTPCode(code int) bool {
@@ -1,9 +1,17 @@
 package towerapiworker
 
 import (
+	"context"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/governance"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/logger"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/ratelimit"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
+	"github.com/stretchr/testify/assert"
 )
 
 const jobs15 string = "/api/v2/jobs/15"
@@ -48,6 +56,36 @@ func TestGet(t *testing.T) {
 	ts.runSuccess(t, jp, 200, responseBody, responses)
 }
 
+func TestGetDataPolicy(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"count": 2, "previous": null, "next": null, "results": [ {"name": "jt1", "id": 1, "url": "url1", "extra_vars": "secret: 1"},{"name": "jt2", "id": 2, "url": "url2", "type": "credential"}]}`}
+	responses := []map[string]interface{}{
+		{
+			"count":    float64(2),
+			"previous": nil,
+			"next":     nil,
+			"results":  []interface{}{map[string]interface{}{"id": float64(1), "name": "jt1"}},
+		},
+	}
+	jp := common.JobParam{
+		Method:      "get",
+		HrefSlug:    "/api/v2/job_templates",
+		ApplyFilter: "results[].{id:id, name:name, url:url, extra_vars:extra_vars, type:type}",
+	}
+
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	enforcer := (&governance.Policy{Types: map[string][]string{"job_template": {"id", "name"}}}).Enforcer()
+	ts.context = governance.WithEnforcer(ts.context, enforcer)
+	ts.runSuccessWith(t, jp, responses)
+
+	dropped := enforcer.Manifest().Dropped
+	if assert.Equal(t, 2, len(dropped)) {
+		assert.Equal(t, governance.Drop{Page: "/api/v2/job_templates/page1.json", Type: "job_template", URL: "url1", Fields: []string{"extra_vars", "type", "url"}}, dropped[0])
+		assert.Equal(t, governance.Drop{Page: "/api/v2/job_templates/page1.json", Type: "credential", URL: "url2", Object: true}, dropped[1])
+	}
+}
+
 func TestMonitor(t *testing.T) {
 	t.Parallel()
 	responseBody := []string{`{"name": "job15", "id": 15, "url": "url15","status":"waiting"}`,
@@ -105,6 +143,55 @@ func TestMonitorStatusInvalid(t *testing.T) {
 	ts.runFail(t, jp, 200, responseBody, errors)
 }
 
+func TestMonitorStatusNotString(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"name": "job15", "id": 15, "url": "url15", "status": 5}`}
+	errors := []string{"URL: /api/v2/jobs/15 Status: 0 Message: Field status has an unexpected type json.Number"}
+	jp := common.JobParam{
+		Method:   "monitor",
+		HrefSlug: jobs15,
+	}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, responseBody, errors)
+}
+
+func TestLaunchURLMissing(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"name": "job1", "id": 1}`}
+	errors := []string{"URL: /api/v2/job_templates/5/launch Status: 0 Message: Field url has an unexpected type <nil>"}
+	jp := common.JobParam{
+		Method:   "launch",
+		HrefSlug: "/api/v2/job_templates/5/launch",
+	}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, responseBody, errors)
+}
+
+func TestRelatedNotString(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"count": 1, "results": [{"id": 1, "related_url": {"href": "/api/v2/inventories/1/hosts"}}]}`}
+	errors := []string{"URL: /api/v2/inventories Status: 0 Message: Field results[0].related_url has an unexpected type map[string]interface {}"}
+	jp := common.JobParam{
+		Method:       "get",
+		HrefSlug:     "/api/v2/inventories",
+		FetchRelated: []interface{}{map[string]interface{}{"href_slug": "related_url"}},
+	}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, responseBody, errors)
+}
+
+func TestFetchRelatedInvalid(t *testing.T) {
+	t.Parallel()
+	errors := []string{"URL: /api/v2/inventories Status: 0 Message: Field fetch_related[0] has an unexpected type string"}
+	jp := common.JobParam{
+		Method:       "get",
+		HrefSlug:     "/api/v2/inventories",
+		FetchRelated: []interface{}{"related_url"},
+	}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, []string{}, errors)
+}
+
 func TestPost(t *testing.T) {
 	t.Parallel()
 	responseBody := []string{`{"name": "job1", "id": 1, "artifacts":{"expose_to_redhat_com_name": "Fred"}}`}
@@ -135,3 +222,175 @@ func TestUnknownMethod(t *testing.T) {
 	ts := &testScaffold{}
 	ts.runFail(t, jp, 200, responseBody, errors)
 }
+
+func TestGetRetry(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{"Bad Gateway", "Too Many Requests", `{"name": "jt1", "id": 1}`}
+	responses := []map[string]interface{}{
+		{
+			"name": "jt1",
+			"id":   float64(1),
+		},
+	}
+	jp := common.JobParam{
+		Method:   "get",
+		HrefSlug: "/api/v2/job_templates/1",
+	}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ts.config.Retry = retry.Policy{MaxAttempts: 3, BaseBackoff: time.Millisecond}
+	ts.config.RateLimiter = ratelimit.MakeLimiter(1000, 10)
+	ts.client = fakeClientWithStatuses(t, responseBody, []int{502, 429, 200})
+	ts.runSuccessWith(t, jp, responses)
+	// halved by the 429 and partially recovered by the 200
+	assert.Equal(t, float64(550), ts.config.RateLimiter.Rate())
+}
+
+func TestGetRetryExhausted(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{"Bad Gateway", "Unavailable"}
+	errors := []string{
+		"URL: /api/v2/job_templates/1 Status: 502 Message: Attempt 1 of 2: Bad Gateway",
+		"URL: /api/v2/job_templates/1 Status: 503 Message: Attempt 2 of 2: Unavailable",
+	}
+	jp := common.JobParam{
+		Method:   "get",
+		HrefSlug: "/api/v2/job_templates/1",
+	}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ts.config.Retry = retry.Policy{MaxAttempts: 2, BaseBackoff: time.Millisecond}
+	ts.client = fakeClientWithStatuses(t, responseBody, []int{502, 503})
+	ts.runFailWith(t, jp, errors)
+
+	for i, e := range ts.receivedJobErrors {
+		assert.Equal(t, "get", e.Method)
+		assert.Equal(t, i+1, e.Attempt)
+		assert.Equal(t, 2, e.Attempts)
+		assert.True(t, e.Retryable)
+		assert.False(t, e.Timestamp.IsZero())
+	}
+	assert.True(t, ts.receivedJobErrors[1].Timestamp.After(ts.receivedJobErrors[0].Timestamp), "Every attempt has its own timestamp")
+}
+
+func TestGetRetryCancelled(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{"Unavailable"}
+	errors := []string{"URL: /api/v2/job_templates/1 Status: 503 Message: Unavailable"}
+	jp := common.JobParam{
+		Method:   "get",
+		HrefSlug: "/api/v2/job_templates/1",
+	}
+	ts := &testScaffold{}
+	ts.base(t, jp, 503, responseBody)
+	ts.config.Retry = retry.Policy{MaxAttempts: 3, BaseBackoff: time.Minute}
+	ctx, cancel := context.WithCancel(ts.context)
+	defer cancel()
+	ts.context = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+	ts.runFailWith(t, jp, errors)
+
+	e := ts.receivedJobErrors[0]
+	assert.Equal(t, 1, e.Attempts, "The attempt made before the cancel is reported")
+	assert.True(t, e.Retryable)
+}
+
+func TestGetFailedDetail(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"detail": "Not found."}`}
+	jp := common.JobParam{
+		Method:   "get",
+		HrefSlug: "/api/v2/job_templates/1/survey_spec",
+	}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 404, responseBody, []string{`URL: /api/v2/job_templates/1/survey_spec Status: 404 Message: {"detail": "Not found."}`})
+
+	e := ts.receivedJobErrors[0]
+	assert.Equal(t, "Not found.", e.Detail)
+	assert.Equal(t, 1, e.Attempt)
+	assert.Equal(t, 1, e.Attempts)
+	assert.False(t, e.Retryable)
+}
+
+func TestPostNotRetried(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{"Bad Gateway"}
+	errors := []string{"URL: /api/v2/job_templates/5/launch Status: 502 Message: Bad Gateway"}
+	jp := common.JobParam{
+		Method:   "launch",
+		HrefSlug: "/api/v2/job_templates/5/launch",
+	}
+	ts := &testScaffold{}
+	ts.base(t, jp, 502, responseBody)
+	ts.config.Retry = retry.Policy{MaxAttempts: 3, BaseBackoff: time.Millisecond}
+	ts.runFailWith(t, jp, errors)
+}
+
+func TestMonitorCancelled(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"name": "job15", "id": 15, "url": "url15", "status":"running"}`}
+	jp := common.JobParam{
+		Method:                 "monitor",
+		HrefSlug:               jobs15,
+		RefreshIntervalSeconds: 10,
+	}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ctx, cancel := context.WithCancel(ts.context)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	apiw := &DefaultAPIWorker{}
+	err := apiw.StartWork(ctx, ts.config, jp, ts.client, ts.channels)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "Monitor should stop when cancelled")
+	assert.Len(t, ts.client.Transport.(*fakeTransport).requests, 1, "The Tower job is only cancelled on request")
+}
+
+func TestMonitorCancelJob(t *testing.T) {
+	t.Parallel()
+	responseBody := []string{`{"name": "job15", "id": 15, "url": "url15", "status":"running"}`, `{}`}
+	jp := common.JobParam{
+		Method:                 "monitor",
+		HrefSlug:               jobs15,
+		RefreshIntervalSeconds: 10,
+	}
+	ts := &testScaffold{}
+	ts.base(t, jp, 202, responseBody)
+	ctx, markCancelJobs := WithJobCancellation(ts.context)
+	ctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, func() {
+		markCancelJobs()
+		cancel()
+	})
+
+	apiw := &DefaultAPIWorker{}
+	err := apiw.StartWork(ctx, ts.config, jp, ts.client, ts.channels)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"GET /api/v2/jobs/15", "POST /api/v2/jobs/15/cancel/"}, ts.client.Transport.(*fakeTransport).requests)
+}
+
+func TestSetClient(t *testing.T) {
+	w := &workUnit{glog: logger.GetLogger(logger.CtxWithLoggerID(context.Background(), "123")), config: &common.CatalogConfig{}}
+	w.setClient(nil)
+	assert.Nil(t, w.client.Transport, "Should use the default transport")
+
+	w.config.SkipVerifyCertificate = true
+	w.setClient(nil)
+	tr, ok := w.client.Transport.(*http.Transport)
+	assert.True(t, ok)
+	assert.True(t, tr.TLSClientConfig.InsecureSkipVerify)
+}
+
+func TestFetchTowerIdentity(t *testing.T) {
+	ts := &testScaffold{}
+	ts.base(t, common.JobParam{}, 200, []string{`{"ha": false, "version": "3.8.1", "active_node": "node1", "install_uuid": "8ed2ad0c-5a41-4b1e-a0b1-3a1c44ef34d1"}`})
+	identity, err := FetchTowerIdentity(ts.context, ts.config, ts.client)
+	assert.NoError(t, err)
+	assert.Equal(t, TowerIdentity{UUID: "8ed2ad0c-5a41-4b1e-a0b1-3a1c44ef34d1", Name: "www.example.com", Version: "3.8.1"}, identity)
+	assert.Equal(t, []string{"GET /api/v2/ping/"}, ts.client.Transport.(*fakeTransport).requests)
+
+	ts.base(t, common.JobParam{}, 404, []string{"Not Found"})
+	_, err = FetchTowerIdentity(ts.context, ts.config, ts.client)
+	assert.Error(t, err)
+}
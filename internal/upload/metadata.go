@@ -0,0 +1,104 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/encryption"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/signature"
+	"github.com/spf13/viper"
+)
+
+const defaultContentType = "application/vnd.redhat.catalog.filename+tgz"
+
+// Metadata describes an uploaded tar file, it is sent as a JSON part next to the file
+type Metadata struct {
+	TaskURL       string               `json:"task_url"`
+	WorkerVersion string               `json:"worker_version"`
+	TowerUUID     string               `json:"tower_uuid,omitempty"`
+	TowerName     string               `json:"tower_name,omitempty"`
+	SHA256        string               `json:"sha256"` // The sha256 of the plain tar file
+	Size          int64                `json:"size"`
+	Jobs          []common.JobParam    `json:"jobs"`
+	Encryption    *encryption.Envelope `json:"encryption,omitempty"` // Set if the tar file is encrypted
+}
+
+// taskIDContentType reports if the upload uses the compatibility mode, which sends
+// the task id in the content type of the file instead of a metadata part
+func taskIDContentType() bool {
+	return viper.GetBool("worker.upload.task_id_content_type")
+}
+
+// fileContentType returns the content type of the file part
+func fileContentType(contentType string, md *Metadata) string {
+	if taskIDContentType() {
+		return overrideContentType(md)
+	}
+	if contentType == "" {
+		return defaultContentType
+	}
+	return contentType
+}
+
+// createMetadataPart adds the metadata as a JSON part, unless the compatibility mode is used
+func createMetadataPart(m *multipart.Writer, md *Metadata) error {
+	if md == nil || taskIDContentType() {
+		return nil
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="metadata"`)
+	h.Set("Content-Type", "application/json")
+	part, err := m.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(b)
+	return err
+}
+
+// sign returns the signature of the archive described by md, empty if signing is disabled
+func sign(md *Metadata) (string, error) {
+	if md == nil || !signature.Enabled() {
+		return "", nil
+	}
+	jws, err := signature.Sign(signature.Payload{SHA256: md.SHA256, Size: md.Size, TaskURL: md.TaskURL})
+	if err != nil {
+		return "", fmt.Errorf("%w %v", ErrSigning, err)
+	}
+	return jws, nil
+}
+
+// createSignaturePart adds the signature of the archive as a JWS part if signing is enabled
+func createSignaturePart(m *multipart.Writer, md *Metadata) error {
+	jws, err := sign(md)
+	if err != nil || jws == "" {
+		return err
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="signature"`)
+	h.Set("Content-Type", signature.ContentType)
+	part, err := m.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write([]byte(jws))
+	return err
+}
+
+// overrideContentType inserts the task_id as part of the content type,
+// the ingress service used it before it accepted the metadata part
+func overrideContentType(md *Metadata) string {
+	if md == nil || md.TaskURL == "" {
+		return defaultContentType
+	}
+	parts := strings.Split(md.TaskURL, "/")
+	return fmt.Sprintf("application/vnd.redhat.catalog.%s+tgz", parts[len(parts)-1])
+}
@@ -0,0 +1,281 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	tusVersion         = "1.0.0"
+	defaultChunkSizeMB = 8
+	// maxMetadataHeader bounds the Upload-Metadata header, upload services commonly
+	// reject requests with a header line longer than 8KiB
+	maxMetadataHeader = 4096
+	// statusChecksumMismatch is answered by the upload service when a chunk does not match its checksum
+	statusChecksumMismatch = 460
+)
+
+// ErrResumableUnsupported is returned when the upload service does not advertise resumable uploads
+var ErrResumableUnsupported = errors.New("Upload service does not support resumable uploads")
+
+// ErrMetadataTooLarge is returned when the metadata of an upload does not fit in the Upload-Metadata header
+var ErrMetadataTooLarge = errors.New("Upload metadata is too large for a resumable upload")
+
+// ResumableOptions configures the chunked uploads
+type ResumableOptions struct {
+	ChunkSize int64        // Bytes sent in a single request
+	Retry     retry.Policy // Attempts and backoff for a chunk, the attempts start over once a chunk is stored
+}
+
+// ResumableEnabled reports if tar files are uploaded in chunks when the upload service supports it
+func ResumableEnabled() bool {
+	return viper.GetBool("worker.upload.resumable")
+}
+
+func resumableOptions() ResumableOptions {
+	opts := ResumableOptions{ChunkSize: defaultChunkSizeMB * 1024 * 1024, Retry: retry.MakePolicy("worker.upload")}
+	if viper.IsSet("worker.upload.chunk_size_mb") {
+		opts.ChunkSize = viper.GetInt64("worker.upload.chunk_size_mb") * 1024 * 1024
+	}
+	// A chunk carries its offset, sending it again can't duplicate data
+	opts.Retry.RetryNonIdempotent = true
+	return opts
+}
+
+// UploadAt uploads size bytes of file with metadata to the url. With resumable uploads enabled the
+// file is sent in chunks if the upload service supports it, otherwise in a single request.
+func UploadAt(url string, file io.ReaderAt, size int64, contentType string, md *Metadata) ([]byte, error) {
+	if ResumableEnabled() {
+		b, err := UploadResumable(url, file, size, contentType, md, resumableOptions())
+		if err != ErrResumableUnsupported && err != ErrMetadataTooLarge {
+			return b, err
+		}
+		log.Infof("%v, uploading in a single request", err)
+	}
+	return UploadSized(url, io.NewSectionReader(file, 0, size), size, contentType, md)
+}
+
+// UploadResumable uploads size bytes of file in chunks with the tus resumable upload protocol,
+// using its creation and checksum extensions. The metadata and the signature are sent in the
+// Upload-Metadata header of the creation request. Every chunk carries its sha256. After a chunk
+// fails the offset stored by the upload service is queried and the upload resumes from there.
+// ErrResumableUnsupported is returned if the upload service does not advertise the protocol,
+// ErrMetadataTooLarge if the header would exceed maxMetadataHeader. A single request sends both.
+// The upload is described by the body of the response to the last chunk, tus answers it with
+// 204 and no body though and the response can be lost after the chunk was stored. Without a
+// body the upload is described by its location.
+func UploadResumable(uploadURL string, file io.ReaderAt, size int64, contentType string, md *Metadata, opts ResumableOptions) ([]byte, error) {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSizeMB * 1024 * 1024
+	}
+	metadata, err := encodeMetadata(contentType, md)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata) > maxMetadataHeader {
+		return nil, ErrMetadataTooLarge
+	}
+	if err := discover(uploadURL); err != nil {
+		return nil, err
+	}
+	location, err := create(uploadURL, size, metadata)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Resumable upload of %d bytes created at %s", size, location)
+
+	var offset int64
+	var body []byte
+	attempts := opts.Retry.Attempts(http.MethodPatch)
+	failures := 0
+	for offset < size {
+		n := opts.ChunkSize
+		if offset+n > size {
+			n = size - offset
+		}
+		next, b, err := sendChunk(location, file, offset, n)
+		if err == nil {
+			offset, body, failures = next, b, 0
+			continue
+		}
+		failures++
+		log.Errorf("Chunk at offset %d failed, attempt %d of %d %v", offset, failures, attempts, err)
+		var se *StatusError
+		if errors.As(err, &se) && !retry.RetryableStatus(se.StatusCode) && se.StatusCode != statusChecksumMismatch && se.StatusCode != http.StatusConflict {
+			return nil, err
+		}
+		if failures >= attempts {
+			return nil, err
+		}
+		time.Sleep(opts.Retry.Backoff(failures, nil))
+		if stored, err := storedOffset(location); err == nil {
+			// A response to a chunk stored before is not the response to the last chunk
+			offset, body = stored, nil
+		} else {
+			log.Errorf("Error querying the offset of %s %v", location, err)
+		}
+	}
+	log.Infof("Resumable upload to %s completed", location)
+	if len(bytes.TrimSpace(body)) == 0 {
+		return json.Marshal(map[string]string{"location": location})
+	}
+	return body, nil
+}
+
+// discover checks that the upload service supports the creation and checksum extensions with sha256
+func discover(uploadURL string) error {
+	req, err := http.NewRequest(http.MethodOptions, uploadURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, _, err := do(req)
+	if err != nil {
+		return err
+	}
+	if resp.Header.Get("Tus-Resumable") == "" ||
+		!listed(resp.Header.Get("Tus-Extension"), "creation") ||
+		!listed(resp.Header.Get("Tus-Extension"), "checksum") ||
+		!listed(resp.Header.Get("Tus-Checksum-Algorithm"), "sha256") {
+		return ErrResumableUnsupported
+	}
+	return nil
+}
+
+// create starts an upload with the encoded metadata and returns its location
+func create(uploadURL string, size int64, metadata string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, uploadURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("Upload-Metadata", metadata)
+	resp, body, err := do(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.String() == "" {
+		return "", fmt.Errorf("Upload service returned an invalid location %q", resp.Header.Get("Location"))
+	}
+	return req.URL.ResolveReference(location).String(), nil
+}
+
+// sendChunk sends n bytes from offset and returns the offset stored by the upload service
+func sendChunk(location string, file io.ReaderAt, offset int64, n int64) (int64, []byte, error) {
+	chunk := make([]byte, n)
+	if _, err := file.ReadAt(chunk, offset); err != nil && err != io.EOF {
+		return offset, nil, err
+	}
+	sum := sha256.Sum256(chunk)
+	req, err := http.NewRequest(http.MethodPatch, location, bytes.NewReader(chunk))
+	if err != nil {
+		return offset, nil, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+	resp, body, err := do(req)
+	if err != nil {
+		return offset, nil, err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return offset, nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	next, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return offset, nil, fmt.Errorf("Upload service returned an invalid offset %q", resp.Header.Get("Upload-Offset"))
+	}
+	return next, body, nil
+}
+
+// storedOffset asks the upload service how many bytes of the upload it has stored
+func storedOffset(location string) (int64, error) {
+	req, err := http.NewRequest(http.MethodHead, location, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	resp, _, err := do(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return 0, &StatusError{StatusCode: resp.StatusCode}
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func do(req *http.Request) (*http.Response, []byte, error) {
+	client, err := common.MakeHTTPClient(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// encodeMetadata encodes the Upload-Metadata header with the file name and content type
+// of the upload. The metadata is added as JSON unless the compatibility mode is used,
+// the signature of the archive if signing is enabled.
+func encodeMetadata(contentType string, md *Metadata) (string, error) {
+	all := map[string]string{"filename": "inventory.tgz", "content_type": fileContentType(contentType, md)}
+	if md != nil && !taskIDContentType() {
+		b, err := json.Marshal(md)
+		if err != nil {
+			return "", err
+		}
+		all["metadata"] = string(b)
+	}
+	jws, err := sign(md)
+	if err != nil {
+		return "", err
+	}
+	if jws != "" {
+		all["signature"] = jws
+	}
+	pairs := make([]string, 0, len(all))
+	for k, v := range all {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ","), nil
+}
+
+func listed(header string, value string) bool {
+	for _, v := range strings.Split(header, ",") {
+		if strings.TrimSpace(v) == value {
+			return true
+		}
+	}
+	return false
+}
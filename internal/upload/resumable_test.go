@@ -0,0 +1,269 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/signature"
+)
+
+// tusServer is a stand-in for an upload service supporting resumable uploads.
+// It drops the connection in the middle of the chunks listed in drop, after storing
+// the chunks listed in lose and corrupts the chunks listed in corrupt before their
+// checksum is verified. Unless describe is set it answers the last chunk like every
+// other chunk, with 204 and no body, as tus does. Like a tus server it answers any
+// other request, e.g. a POST to the upload location, with 405.
+type tusServer struct {
+	mu       sync.Mutex
+	length   int64
+	data     []byte
+	metadata string
+	patches  int
+	received int64 // bytes of all chunks including the dropped ones
+	drop     map[int]bool
+	lose     map[int]bool
+	corrupt  map[int]bool
+	describe bool
+}
+
+func (s *tusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Tus-Resumable", tusVersion)
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Tus-Extension", "creation,checksum")
+		w.Header().Set("Tus-Checksum-Algorithm", "md5,sha256")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && r.URL.Path == "/upload":
+		s.length, _ = strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		s.metadata = r.Header.Get("Upload-Metadata")
+		w.Header().Set("Location", "/upload/files/1")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.data)))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPatch:
+		s.patches++
+		if r.Header.Get("Upload-Offset") != strconv.Itoa(len(s.data)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if s.drop[s.patches] {
+			half := make([]byte, r.ContentLength/2)
+			n, _ := r.Body.Read(half)
+			s.received += int64(n)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		chunk, _ := ioutil.ReadAll(r.Body)
+		s.received += int64(len(chunk))
+		if s.corrupt[s.patches] {
+			chunk[0]++
+		}
+		sum := sha256.Sum256(chunk)
+		if r.Header.Get("Upload-Checksum") != "sha256 "+base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(statusChecksumMismatch)
+			return
+		}
+		s.data = append(s.data, chunk...)
+		if s.lose[s.patches] {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.data)))
+		if s.describe && int64(len(s.data)) == s.length {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"request_id": "42"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testOptions() ResumableOptions {
+	return ResumableOptions{ChunkSize: 100, Retry: retry.Policy{MaxAttempts: 3, BaseBackoff: time.Millisecond, RetryNonIdempotent: true}}
+}
+
+func TestUploadResumable(t *testing.T) {
+	s := &tusServer{drop: map[int]bool{3: true}, corrupt: map[int]bool{5: true}, describe: true}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	data := []byte(strings.Repeat("0123456789", 45))
+	md := &Metadata{
+		TaskURL:       "https://www.example.com/12345678",
+		WorkerVersion: "1.0",
+		SHA256:        "abc",
+		Size:          int64(len(data)),
+		Jobs:          []common.JobParam{{Method: "get", HrefSlug: "/api/v2/inventories/"}},
+	}
+	body, err := UploadResumable(ts.URL+"/upload", bytes.NewReader(data), int64(len(data)), "", md, testOptions())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"request_id": "42"}`, string(body))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, data, s.data)
+	// 5 chunks, the dropped and the corrupted chunk are sent again
+	assert.Equal(t, 7, s.patches)
+	assert.Equal(t, int64(len(data)+50+100), s.received, "Only the failed chunks are sent again")
+	b, _ := json.Marshal(md)
+	assert.Equal(t, string(b), metadataEntry(s.metadata, "metadata"))
+	assert.Equal(t, defaultContentType, metadataEntry(s.metadata, "content_type"))
+}
+
+// metadataEntry returns the decoded value of key in an Upload-Metadata header
+func metadataEntry(header string, key string) string {
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.SplitN(pair, " ", 2)
+		if kv[0] == key && len(kv) == 2 {
+			b, _ := base64.StdEncoding.DecodeString(kv[1])
+			return string(b)
+		}
+	}
+	return ""
+}
+
+func TestUploadResumableSigned(t *testing.T) {
+	viper.Set("worker.upload.sign", true)
+	defer viper.Set("worker.upload.sign", nil)
+	useTestCertificate(t)
+	s := &tusServer{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	data := []byte(strings.Repeat("0123456789", 45))
+	md := &Metadata{TaskURL: "https://www.example.com/12345678", SHA256: "abc", Size: int64(len(data))}
+	_, err := UploadResumable(ts.URL+"/upload", bytes.NewReader(data), int64(len(data)), "", md, testOptions())
+	assert.NoError(t, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, _ := signedPayload(t, metadataEntry(s.metadata, "signature"))
+	assert.Equal(t, signature.Payload{SHA256: "abc", Size: int64(len(data)), TaskURL: md.TaskURL}, p)
+}
+
+func TestUploadResumableGivesUp(t *testing.T) {
+	s := &tusServer{drop: map[int]bool{2: true, 3: true, 4: true}}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	data := []byte(strings.Repeat("0123456789", 45))
+	_, err := UploadResumable(ts.URL+"/upload", bytes.NewReader(data), int64(len(data)), "", nil, testOptions())
+	assert.Error(t, err)
+}
+
+func TestUploadResumableLocation(t *testing.T) {
+	s := &tusServer{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	data := []byte(strings.Repeat("0123456789", 45))
+	body, err := UploadResumable(ts.URL+"/upload", bytes.NewReader(data), int64(len(data)), "", nil, testOptions())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"location": "`+ts.URL+`/upload/files/1"}`, string(body))
+}
+
+func TestUploadResumableResponseLost(t *testing.T) {
+	s := &tusServer{lose: map[int]bool{5: true}, describe: true}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	data := []byte(strings.Repeat("0123456789", 45))
+	body, err := UploadResumable(ts.URL+"/upload", bytes.NewReader(data), int64(len(data)), "", nil, testOptions())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"location": "`+ts.URL+`/upload/files/1"}`, string(body))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, data, s.data)
+	assert.Equal(t, 5, s.patches, "The stored chunk is not sent again")
+}
+
+func TestUploadResumableUnsupported(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer ts.Close()
+
+	_, err := UploadResumable(ts.URL+"/upload", strings.NewReader("data"), 4, "", nil, testOptions())
+	assert.Equal(t, ErrResumableUnsupported, err)
+}
+
+func TestUploadAtFallback(t *testing.T) {
+	viper.Set("worker.upload.resumable", true)
+	defer viper.Set("worker.upload.resumable", nil)
+	data := strings.Repeat("na", 512)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, data, readFilePart(t, r))
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write([]byte("mock body"))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	md := &Metadata{TaskURL: "https://www.example.com/12345678"}
+	body, err := UploadAt(ts.URL+"/upload", strings.NewReader(data), int64(len(data)), "", md)
+	assert.NoError(t, err)
+	assert.Equal(t, "mock body", string(body))
+}
+
+func TestUploadAtLargeMetadata(t *testing.T) {
+	viper.Set("worker.upload.resumable", true)
+	defer viper.Set("worker.upload.resumable", nil)
+	s := &tusServer{}
+	var single *Metadata
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			s.ServeHTTP(w, r)
+			return
+		}
+		_, single = readParts(t, r)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"request_id": "42"}`))
+	}))
+	defer ts.Close()
+
+	data := strings.Repeat("na", 512)
+	md := &Metadata{TaskURL: "https://www.example.com/12345678"}
+	for i := 0; i < 100; i++ {
+		md.Jobs = append(md.Jobs, common.JobParam{Method: "get", HrefSlug: fmt.Sprintf("/api/v2/job_templates/%d/survey_spec/", i)})
+	}
+	body, err := UploadAt(ts.URL+"/upload", strings.NewReader(data), int64(len(data)), "", md)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"request_id": "42"}`, string(body))
+	if assert.NotNil(t, single, "The metadata is sent with a single request") {
+		assert.Equal(t, 100, len(single.Jobs))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Empty(t, s.metadata, "No resumable upload is created")
+	assert.Equal(t, 0, s.patches)
+}
@@ -1,53 +1,132 @@
 package upload
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
-	"os"
-	"strings"
 
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
 	log "github.com/sirupsen/logrus"
 )
 
-// Upload uploads a file with metadata to the url
-func Upload(url string, filename string, contentType string, metadata map[string]string) ([]byte, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("Error opening file %s %v", filename, err)
+// ErrChunkedRejected is returned when the upload service does not accept
+// a request body sent with chunked transfer encoding
+var ErrChunkedRejected = errors.New("Upload service rejected chunked transfer encoding")
+
+// ErrSigning is returned when the archive can't be signed with the consumer certificate
+var ErrSigning = errors.New("Failed to sign the tar file")
+
+// StatusError is returned when the upload service answers with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Upload failed %d %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports if a failed upload might succeed later. Network errors
+// and transient statuses of the upload service are retryable.
+func Retryable(err error) bool {
+	if err == nil || err == ErrChunkedRejected || errors.Is(err, ErrSigning) {
+		return false
 	}
-	defer file.Close()
+	var se *StatusError
+	if errors.As(err, &se) {
+		return retry.RetryableStatus(se.StatusCode)
+	}
+	return true
+}
+
+// UploadStream uploads the data produced by write with metadata to the url. The data is
+// streamed with chunked transfer encoding while write produces it, so it is never stored.
+// ErrChunkedRejected is returned if the upload service requires the content length upfront.
+// The metadata and signature parts follow the file, so write can still complete md.
+func UploadStream(url string, write func(io.Writer) error, contentType string, md *Metadata) ([]byte, error) {
 	r, w := io.Pipe()
 	m := multipart.NewWriter(w)
+	signErr := make(chan error, 1)
 	go func() {
-		defer w.Close()
-		defer m.Close()
-
-		h := make(textproto.MIMEHeader)
-		h.Set("Content-Disposition",
-			fmt.Sprintf(`form-data; name="file"; filename="%s"`, "inventory.tgz"))
-		// TODO : Set the metadata when the ingress service supports it
-		// For now override the ContentType to include the task_id
-
-		h.Set("Content-Type", overrideContentType(metadata))
-		part, err := m.CreatePart(h)
-		if err != nil {
-			return
+		part, err := createFilePart(m, contentType, md)
+		if err == nil {
+			err = write(part)
+		}
+		if err == nil {
+			err = createMetadataPart(m, md)
+		}
+		if err == nil {
+			err = createSignaturePart(m, md)
+			signErr <- err
 		}
-		if _, err = io.Copy(part, file); err != nil {
-			return
+		if err == nil {
+			err = m.Close()
 		}
+		w.CloseWithError(err)
 	}()
+	defer r.Close()
 
-	req, err := http.NewRequest("POST", url, r)
+	b, err := post(url, r, -1, m.FormDataContentType())
+	select {
+	case serr := <-signErr:
+		if serr != nil {
+			// The aborted request hides the cause
+			return nil, serr
+		}
+	default:
+	}
+	return b, err
+}
+
+// UploadSized uploads size bytes read from file with metadata to the url.
+// The content length of the request is set so no chunked transfer encoding is used.
+func UploadSized(url string, file io.Reader, size int64, contentType string, md *Metadata) ([]byte, error) {
+	var head, tail bytes.Buffer
+	m := multipart.NewWriter(&head)
+	if _, err := createFilePart(m, contentType, md); err != nil {
+		return nil, err
+	}
+	headLen := head.Len()
+	if err := createMetadataPart(m, md); err != nil {
+		return nil, err
+	}
+	if err := createSignaturePart(m, md); err != nil {
+		return nil, err
+	}
+	if err := m.Close(); err != nil {
+		return nil, err
+	}
+	// The metadata and signature parts and the trailing boundary go after the file
+	tail.Write(head.Bytes()[headLen:])
+	head.Truncate(headLen)
+
+	body := io.MultiReader(&head, io.LimitReader(file, size), &tail)
+	return post(url, body, int64(head.Len())+size+int64(tail.Len()), m.FormDataContentType())
+}
+
+func createFilePart(m *multipart.Writer, contentType string, md *Metadata) (io.Writer, error) {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition",
+		fmt.Sprintf(`form-data; name="file"; filename="%s"`, "inventory.tgz"))
+	h.Set("Content-Type", fileContentType(contentType, md))
+	return m.CreatePart(h)
+}
+
+func post(url string, body io.Reader, length int64, formContentType string) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", m.FormDataContentType())
+	req.Header.Set("Content-Type", formContentType)
+	if length >= 0 {
+		req.ContentLength = length
+	}
 
 	client, err := common.MakeHTTPClient(req)
 	if err != nil {
@@ -60,29 +139,19 @@ func Upload(url string, filename string, contentType string, metadata map[string
 	}
 
 	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	resBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		log.Errorf("Error reading body %v", err)
 		return nil, err
 	}
+	if length < 0 && (res.StatusCode == http.StatusLengthRequired || res.StatusCode == http.StatusNotImplemented) {
+		log.Errorf("Chunked upload rejected %d %s", res.StatusCode, string(resBody))
+		return nil, ErrChunkedRejected
+	}
 	if res.StatusCode != http.StatusAccepted {
-		err = fmt.Errorf("Upload failed %d %s", res.StatusCode, string(body))
-		return nil, err
+		return nil, &StatusError{StatusCode: res.StatusCode, Body: string(resBody)}
 	}
 	log.Info("Response from upload " + url + " Status " + res.Status)
-	log.Infof("Response from Post %s", string(body))
-	return body, nil
-}
-
-// overrideContentType inserts the task_id as part of the content tye
-// till we can get a more permanent solution to send metadata along
-// with multipart contents
-func overrideContentType(metadata map[string]string) string {
-	ct := "application/vnd.redhat.catalog.filename+tgz"
-	if val, ok := metadata["task_url"]; ok {
-		parts := strings.Split(val, "/")
-		taskID := parts[len(parts)-1]
-		ct = fmt.Sprintf("application/vnd.redhat.catalog.%s+tgz", taskID)
-	}
-	return ct
+	log.Infof("Response from Post %s", string(resBody))
+	return resBody, nil
 }
@@ -1,19 +1,37 @@
 package upload
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
-)
 
-const testFileName string = "testuploaddata.file"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/signature"
+)
 
 func TestUpload(t *testing.T) {
+	data := strings.Repeat("na", 512)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, data, readFilePart(t, r))
 		w.WriteHeader(http.StatusAccepted)
 		_, err := w.Write([]byte("mock body"))
 		assert.NoError(t, err)
@@ -33,19 +51,8 @@ func TestUpload(t *testing.T) {
 
 	defer ts.Close()
 
-	data := []byte(strings.Repeat("na", 512))
-	f, err := os.Create(testFileName)
-	if err != nil {
-		t.Errorf("Failed to create test datafile for uploading. Reason %s", err)
-	}
-	_, err = f.Write(data)
-	assert.NoError(t, err)
-	f.Close()
-	defer os.Remove(testFileName)
-	metadata := map[string]string{
-		"task_url": "https://www.example.com/12345678",
-	}
-	body, err := Upload(ts.URL+"/upload", testFileName, "", metadata)
+	md := &Metadata{TaskURL: "https://www.example.com/12345678"}
+	body, err := UploadAt(ts.URL+"/upload", strings.NewReader(data), int64(len(data)), "", md)
 	if err != nil {
 		t.Error("ERROR from Upload:", err)
 	}
@@ -53,3 +60,280 @@ func TestUpload(t *testing.T) {
 		t.Error("Retrieved body is not expected")
 	}
 }
+
+func readFilePart(t *testing.T, r *http.Request) string {
+	data, _ := readParts(t, r)
+	return data
+}
+
+// readParts returns the file and the metadata of an upload
+func readParts(t *testing.T, r *http.Request) (string, *Metadata) {
+	reader, err := r.MultipartReader()
+	if !assert.NoError(t, err) {
+		return "", nil
+	}
+	part, err := reader.NextPart()
+	if !assert.NoError(t, err) {
+		return "", nil
+	}
+	assert.Equal(t, "inventory.tgz", part.FileName())
+	assert.Equal(t, defaultContentType, part.Header.Get("Content-Type"))
+	b, err := ioutil.ReadAll(part)
+	assert.NoError(t, err)
+
+	part, err = reader.NextPart()
+	if err == io.EOF {
+		return string(b), nil
+	}
+	if !assert.NoError(t, err) {
+		return string(b), nil
+	}
+	assert.Equal(t, "metadata", part.FormName())
+	assert.Equal(t, "application/json", part.Header.Get("Content-Type"))
+	md := &Metadata{}
+	assert.NoError(t, json.NewDecoder(part).Decode(md))
+	return string(b), md
+}
+
+func TestUploadStream(t *testing.T) {
+	data := strings.Repeat("na", 512)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"chunked"}, r.TransferEncoding)
+		assert.Equal(t, data, readFilePart(t, r))
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write([]byte("mock body"))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	md := &Metadata{TaskURL: "https://www.example.com/12345678"}
+	body, err := UploadStream(ts.URL+"/upload", func(w io.Writer) error {
+		_, err := w.Write([]byte(data))
+		return err
+	}, "", md)
+	assert.NoError(t, err)
+	assert.Equal(t, "mock body", string(body))
+}
+
+func TestUploadStreamMetadata(t *testing.T) {
+	data := strings.Repeat("na", 512)
+	jobs := []common.JobParam{{Method: "GET", HrefSlug: "/api/v2/job_templates"}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, md := readParts(t, r)
+		assert.Equal(t, data, file)
+		if assert.NotNil(t, md) {
+			assert.Equal(t, "https://www.example.com/12345678", md.TaskURL)
+			assert.Equal(t, "1.0", md.WorkerVersion)
+			assert.Equal(t, "8ed2ad0c", md.TowerUUID)
+			assert.Equal(t, "tower.example.com", md.TowerName)
+			assert.Equal(t, "abc", md.SHA256, "The metadata follows the file so its digest is known")
+			assert.Equal(t, int64(len(data)), md.Size)
+			assert.Equal(t, jobs, md.Jobs)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	md := &Metadata{TaskURL: "https://www.example.com/12345678", WorkerVersion: "1.0", TowerUUID: "8ed2ad0c", TowerName: "tower.example.com", Jobs: jobs}
+	_, err := UploadStream(ts.URL+"/upload", func(w io.Writer) error {
+		_, err := w.Write([]byte(data))
+		md.SHA256, md.Size = "abc", int64(len(data))
+		return err
+	}, "", md)
+	assert.NoError(t, err)
+}
+
+// useTestCertificate configures a self signed consumer certificate with a P-256 key
+func useTestCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "consumer"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "upload")
+	assert.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	viper.Set("AUTH.client_cert", certFile)
+	viper.Set("AUTH.client_key", keyFile)
+	t.Cleanup(func() {
+		viper.Set("AUTH.client_cert", nil)
+		viper.Set("AUTH.client_key", nil)
+		os.RemoveAll(dir)
+	})
+}
+
+// signedPayload returns the payload of a JWS and the first certificate of its header,
+// the signature itself is checked by the tests of the signature package
+func signedPayload(t *testing.T, jws string) (signature.Payload, *x509.Certificate) {
+	var p signature.Payload
+	var h struct {
+		X5c []string `json:"x5c"`
+	}
+	parts := strings.Split(jws, ".")
+	if !assert.Equal(t, 3, len(parts), "Not a JWS in compact serialization") {
+		return p, nil
+	}
+	for i, v := range []interface{}{&h, &p} {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(b, v))
+	}
+	if !assert.NotEmpty(t, h.X5c) {
+		return p, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(h.X5c[0])
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return p, cert
+}
+
+func TestUploadSigned(t *testing.T) {
+	viper.Set("worker.upload.sign", true)
+	defer viper.Set("worker.upload.sign", nil)
+	useTestCertificate(t)
+	var jws string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if assert.NoError(t, err) {
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					break
+				}
+				if part.FormName() == "signature" {
+					assert.Equal(t, signature.ContentType, part.Header.Get("Content-Type"))
+					b, _ := ioutil.ReadAll(part)
+					jws = string(b)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	md := &Metadata{TaskURL: "https://www.example.com/12345678"}
+	_, err := UploadStream(ts.URL+"/upload", func(w io.Writer) error {
+		_, err := w.Write([]byte("data"))
+		md.SHA256, md.Size = "abc", 4
+		return err
+	}, "", md)
+	assert.NoError(t, err)
+
+	p, cert := signedPayload(t, jws)
+	assert.Equal(t, signature.Payload{SHA256: "abc", Size: 4, TaskURL: "https://www.example.com/12345678"}, p)
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, "consumer", cert.Subject.CommonName)
+	}
+}
+
+func TestUploadSigningFailed(t *testing.T) {
+	viper.Set("worker.upload.sign", true)
+	defer viper.Set("worker.upload.sign", nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	_, err := UploadStream(ts.URL+"/upload", func(w io.Writer) error { return nil }, "", &Metadata{})
+	assert.True(t, errors.Is(err, ErrSigning))
+	assert.False(t, Retryable(err))
+}
+
+func TestUploadTaskIDContentType(t *testing.T) {
+	viper.Set("worker.upload.task_id_content_type", true)
+	defer viper.Set("worker.upload.task_id_content_type", nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if assert.NoError(t, err) {
+			part, err := reader.NextPart()
+			if assert.NoError(t, err) {
+				assert.Equal(t, "application/vnd.redhat.catalog.12345678+tgz", part.Header.Get("Content-Type"))
+			}
+			_, err = reader.NextPart()
+			assert.Equal(t, io.EOF, err, "No metadata part in the compatibility mode")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	md := &Metadata{TaskURL: "https://www.example.com/12345678"}
+	_, err := UploadSized(ts.URL+"/upload", strings.NewReader("data"), 4, "", md)
+	assert.NoError(t, err)
+}
+
+func TestUploadStreamWriteFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	_, err := UploadStream(ts.URL+"/upload", func(w io.Writer) error {
+		return errors.New("compression failed")
+	}, "", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "compression failed")
+	}
+}
+
+func TestUploadChunkedRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusLengthRequired)
+	}))
+	defer ts.Close()
+
+	_, err := UploadStream(ts.URL+"/upload", func(w io.Writer) error { return nil }, "", nil)
+	assert.Equal(t, ErrChunkedRejected, err)
+}
+
+func TestUploadSized(t *testing.T) {
+	data := strings.Repeat("na", 512)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.TransferEncoding)
+		assert.True(t, r.ContentLength > int64(len(data)))
+		file, md := readParts(t, r)
+		assert.Equal(t, data, file)
+		if assert.NotNil(t, md) {
+			assert.Equal(t, "abc", md.SHA256)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write([]byte("mock body"))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	md := &Metadata{TaskURL: "https://www.example.com/12345678", SHA256: "abc", Size: int64(len(data))}
+	body, err := UploadSized(ts.URL+"/upload", strings.NewReader(data), int64(len(data)), "", md)
+	assert.NoError(t, err)
+	assert.Equal(t, "mock body", string(body))
+}
+
+func TestRetryable(t *testing.T) {
+	assert.False(t, Retryable(nil))
+	assert.False(t, Retryable(ErrChunkedRejected))
+	assert.True(t, Retryable(errors.New("connection refused")))
+	assert.True(t, Retryable(&StatusError{StatusCode: http.StatusServiceUnavailable}))
+	assert.False(t, Retryable(&StatusError{StatusCode: http.StatusRequestEntityTooLarge}))
+}
+
+func TestUploadStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusBadGateway)
+		_, err := w.Write([]byte("Bad Gateway"))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	_, err := UploadSized(ts.URL+"/upload", strings.NewReader("data"), 4, "", nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Upload failed 502 Bad Gateway", err.Error())
+		assert.True(t, Retryable(err))
+	}
+}
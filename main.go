@@ -10,7 +10,9 @@ import (
 
 	"github.com/RedHatInsights/rhc-worker-catalog/build"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/common"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/ratelimit"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/request"
+	"github.com/RedHatInsights/rhc-worker-catalog/internal/retry"
 	"github.com/RedHatInsights/rhc-worker-catalog/internal/towerapiworker"
 	log "github.com/sirupsen/logrus"
 	viper "github.com/spf13/viper"
@@ -95,6 +97,8 @@ func makeConfig() *common.CatalogConfig {
 	config.Level = viper.GetString("logger.level")
 	config.MQTTURL = viper.GetString("MQTT_BROKER.url")
 	config.GUID = viper.GetString("MQTT_BROKER.uuid")
+	config.Retry = retry.MakePolicy("worker.retry")
+	config.RateLimiter = ratelimit.MakeLimiterFromConfig("worker.rate_limit")
 
 	flag.Parse()
 	level, err := log.ParseLevel(config.Level)